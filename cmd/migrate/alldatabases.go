@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// databaseResult is the outcome of importing one database with
+// --all-databases.
+type databaseResult struct {
+	Database string `json:"database"`
+	Tables   int    `json:"tables"`
+	Rows     int64  `json:"rows"`
+	Bytes    int64  `json:"bytes"`
+	// Duration is measured in seconds.
+	Duration float64 `json:"duration_seconds"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// importAllDatabases imports every database in the source cluster into a
+// database of the same name on the target, creating those that don't exist
+// yet. Each database is checked and imported in turn, and a failure doesn't
+// stop the remaining databases from being imported.
+func importAllDatabases(ctx context.Context, d deps, opts migrationOpts, summary *migrationSummary) error {
+	if opts.waitForTarget > 0 {
+		if err := waitForTarget(ctx, d.opener, opts.targetURI, opts.waitForTarget); err != nil {
+			return err
+		}
+		opts.waitForTarget = 0
+	}
+
+	databases, err := listDatabases(ctx, d.opener, opts.sourceURI, opts.includePostgres)
+	if err != nil {
+		return classify(ErrSourceUnreachable, fmt.Errorf("failed to list source databases: %w", err))
+	}
+	if len(opts.excludeDatabases) > 0 {
+		var patterns []*regexp.Regexp
+		for _, pattern := range opts.excludeDatabases {
+			patterns = append(patterns, compilePattern(pattern))
+		}
+		var included, excluded []string
+		for _, database := range databases {
+			if matchAny(patterns, database) {
+				excluded = append(excluded, database)
+			} else {
+				included = append(included, database)
+			}
+		}
+		if len(excluded) > 0 {
+			log.Printf("[info] Skipping database(s) excluded by --exclude-database: %s", abbreviateList(excluded))
+		}
+		databases = included
+	}
+	if len(databases) == 0 {
+		return fmt.Errorf("no databases found on source")
+	}
+	log.Printf("[info] Importing %d database(s): %s", len(databases), abbreviateList(databases))
+
+	existing, err := listDatabases(ctx, d.opener, opts.targetURI, true)
+	if err != nil {
+		return classify(ErrTargetUnreachable, fmt.Errorf("failed to list target databases: %w", err))
+	}
+
+	// Roles are shared by the whole cluster, so they're only copied once.
+	if opts.roles && !opts.dryRun {
+		setPhase(phaseRoles)
+		log.Println("[info] Copying roles...")
+		if err := migrateRoles(ctx, d, opts); err != nil {
+			return err
+		}
+	}
+	opts.roles = false
+
+	var failed []string
+	var firstErr error
+	for _, database := range databases {
+		start := time.Now()
+		log.Printf("[info] Importing database %s...", database)
+
+		dbSummary := &migrationSummary{}
+		err := importDatabase(ctx, d, opts, database, contains(existing, database), dbSummary)
+		if ctx.Err() != nil {
+			return err
+		}
+
+		result := databaseResult{
+			Database: database,
+			Tables:   dbSummary.Tables,
+			Rows:     dbSummary.Rows,
+			Bytes:    dbSummary.Bytes,
+			Duration: time.Since(start).Seconds(),
+		}
+		if err != nil {
+			log.Printf("[error] failed to import database %s: %s", database, err)
+			// Only the first line, as the detail that follows is logged above.
+			result.Error, _, _ = strings.Cut(err.Error(), "\n")
+			failed = append(failed, database)
+			if firstErr == nil {
+				firstErr = err
+			}
+		} else {
+			log.Printf("[info] Imported database %s", database)
+		}
+
+		summary.Databases = append(summary.Databases, result)
+		summary.Tables += result.Tables
+		summary.Rows += result.Rows
+		summary.Bytes += result.Bytes
+		summary.TransferDuration += dbSummary.TransferDuration
+		summary.verified = summary.verified || dbSummary.verified
+		if summary.SourceVersion == "" {
+			summary.SourceVersion = dbSummary.SourceVersion
+			summary.TargetVersion = dbSummary.TargetVersion
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to import %d of %d database(s): %s. first failure: %w", len(failed), len(databases), abbreviateList(failed), firstErr)
+	}
+	return nil
+}
+
+// importDatabase runs the pre-checks, import and post-restore steps for a
+// single database of the source cluster. Databases missing from the target
+// are created by the restore, while existing ones are restored into directly.
+func importDatabase(ctx context.Context, d deps, opts migrationOpts, database string, exists bool, summary *migrationSummary) error {
+	var err error
+	if opts.sourceURI, err = withDatabase(opts.sourceURI, database); err != nil {
+		return err
+	}
+	opts.create = !exists
+	if exists {
+		if opts.targetURI, err = withDatabase(opts.targetURI, database); err != nil {
+			return err
+		}
+	}
+
+	setPhase(phasePrechecks)
+	if err := runPreChecks(ctx, d, &opts, summary); err != nil {
+		return err
+	}
+
+	if opts.dryRun {
+		return printPlan(ctx, d, opts)
+	}
+
+	result, err := runMigration(ctx, d, opts)
+	summary.addResult(result)
+	if err != nil {
+		return err
+	}
+
+	return runPostRestore(ctx, d, opts, summary)
+}
+
+// listDatabases returns the names of the databases that can be connected to
+// on the server at uri, excluding templates and, unless includePostgres is
+// set, the postgres maintenance database. template0 and template1 are left
+// out by name too, as they can be unmarked as templates.
+func listDatabases(ctx context.Context, opener ConnOpener, uri string, includePostgres bool) ([]string, error) {
+	conn, err := opener.Open(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = conn.Close(ctx) }()
+
+	rows, err := conn.Query(ctx, `SELECT datname FROM pg_database
+		WHERE NOT datistemplate AND datallowconn AND datname NOT IN ('template0', 'template1')
+			AND ($1 OR datname <> 'postgres')
+		ORDER BY datname`, includePostgres)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
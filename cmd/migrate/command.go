@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// CommandRunner starts external commands such as pg_dump and psql. The
+// default execRunner runs them as child processes, while tests can substitute
+// a fake.
+type CommandRunner interface {
+	Start(ctx context.Context, cmd command) (process, error)
+}
+
+// process is a command that has been started.
+type process interface {
+	// Wait blocks until the command has exited and its output has been
+	// copied.
+	Wait() error
+}
+
+// command describes an external command to run.
+type command struct {
+	name string
+	args []string
+	// env holds variables added to the inherited environment.
+	env    []string
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+// execRunner runs commands as child processes.
+type execRunner struct{}
+
+func (execRunner) Start(ctx context.Context, c command) (process, error) {
+	cmd := exec.CommandContext(ctx, c.name, c.args...)
+	// Children run in their own process group so an interrupt can terminate
+	// them along with anything they spawn.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	// When ctx is done, ask the whole group to shut down, killing the process
+	// if it hasn't exited within the grace period.
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+	}
+	cmd.WaitDelay = terminateGracePeriod
+
+	if len(c.env) > 0 {
+		cmd.Env = append(os.Environ(), c.env...)
+	}
+	cmd.Stdin = c.stdin
+	cmd.Stdout = c.stdout
+	cmd.Stderr = c.stderr
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	children.addGroup(cmd.Process.Pid)
+
+	return &execProcess{cmd: cmd}, nil
+}
+
+type execProcess struct {
+	cmd *exec.Cmd
+}
+
+func (p *execProcess) Wait() error {
+	defer children.removeGroup(p.cmd.Process.Pid)
+	return p.cmd.Wait()
+}
+
+// stage is a single command within a pipeline whose stderr is streamed to the
+// log as it arrives.
+type stage struct {
+	name   string
+	cmd    command
+	stderr *outputLogger
+	// input, when set, transforms the data piped into the stage.
+	input func(io.Reader) io.Reader
+	// output, when set, wraps the writer the stage's stdout is piped into.
+	output func(io.Writer) io.Writer
+	// class, when set, is the class of failure the stage's errors are
+	// placed in.
+	class error
+}
+
+// newStage prepares a stage running the program at path, which is looked up
+// in PATH when it has no separators. Output is logged under its base name.
+func newStage(path string, args ...string) *stage {
+	name := filepath.Base(path)
+	s := &stage{
+		name:   name,
+		stderr: newOutputLogger(fmt.Sprintf("[%s] ", name), stderrTailLines),
+	}
+	s.cmd = command{name: path, args: args, stderr: s.stderr}
+	// Anything else the command prints is only of interest in the log file.
+	if commandLog.enabled() {
+		s.cmd.stdout = &outputLogger{prefix: fmt.Sprintf("[%s] ", name), quiet: true}
+	}
+
+	return s
+}
+
+// newRestoreStage prepares a stage that applies changes to the target, with
+// session settings for the restore passed through PGOPTIONS.
+func newRestoreStage(opts migrationOpts, path string, args ...string) *stage {
+	s := newStage(path, args...)
+
+	var settings []string
+	if opts.statementTimeout > 0 {
+		settings = append(settings, fmt.Sprintf("-c statement_timeout=%d", opts.statementTimeout.Milliseconds()))
+	}
+	if opts.searchPath != "" {
+		settings = append(settings, "-c search_path="+opts.searchPath)
+	}
+	if opts.fastRestore {
+		for _, setting := range fastRestoreSettings {
+			settings = append(settings, fmt.Sprintf("-c %s=%s", setting[0], setting[1]))
+		}
+	}
+
+	if len(settings) > 0 {
+		pgOptions := strings.TrimSpace(os.Getenv("PGOPTIONS") + " " + strings.Join(settings, " "))
+		s.cmd.env = append(s.cmd.env, "PGOPTIONS="+pgOptions)
+	}
+
+	return s
+}
+
+// wrap annotates err with the stage name, exit status and the tail of stderr.
+// When the stage reported a database error, only the output from that error
+// onwards is included so the failing statement isn't buried in noise.
+func (s *stage) wrap(err error) error {
+	s.stderr.Flush()
+
+	detail := s.stderr.ErrorContext()
+	if detail == "" {
+		detail = s.stderr.Tail()
+	} else if sqlstate, statement := parseFailedStatement(detail); sqlstate != "" || statement != "" {
+		err = &statementError{sqlstate: sqlstate, statement: statement, err: err}
+	}
+	if m := lockTimeoutPattern.FindStringSubmatch(detail); m != nil {
+		err = fmt.Errorf("could not acquire lock on %s: %w", m[1], err)
+	}
+
+	if detail != "" {
+		err = fmt.Errorf("%s: %w\n%s", s.name, err, detail)
+	} else {
+		err = fmt.Errorf("%s: %w", s.name, err)
+	}
+	if s.class != nil {
+		return classify(s.class, err)
+	}
+	return err
+}
+
+// run executes the stage to completion.
+func (s *stage) run(ctx context.Context, runner CommandRunner) error {
+	p, err := runner.Start(ctx, s.cmd)
+	if err != nil {
+		return s.wrap(err)
+	}
+	if err := p.Wait(); err != nil {
+		return s.wrap(err)
+	}
+	return nil
+}
+
+// runPipeline streams the stdout of src into the stdin of dst. Unlike a shell
+// pipeline, the exit status of both commands is checked, so a src failure
+// can't be masked by dst successfully consuming a truncated stream. The number
+// of bytes that passed through the pipe is returned.
+func runPipeline(ctx context.Context, runner CommandRunner, src, dst *stage) (int64, error) {
+	pr, pw := io.Pipe()
+	counter := &countingWriter{w: pw}
+	src.cmd.stdout = counter
+	if src.output != nil {
+		src.cmd.stdout = src.output(counter)
+	}
+	dst.cmd.stdin = pr
+	if dst.input != nil {
+		dst.cmd.stdin = dst.input(pr)
+	}
+
+	srcCtx, cancelSrc := context.WithCancel(ctx)
+	defer cancelSrc()
+
+	dstProc, err := runner.Start(ctx, dst.cmd)
+	if err != nil {
+		return 0, dst.wrap(err)
+	}
+
+	srcProc, err := runner.Start(srcCtx, src.cmd)
+	if err != nil {
+		_ = pw.CloseWithError(err)
+		_ = dstProc.Wait()
+		return 0, src.wrap(err)
+	}
+
+	srcDone := make(chan error, 1)
+	go func() {
+		err := srcProc.Wait()
+		// All of src's output has been written, so let dst see EOF.
+		_ = pw.Close()
+		srcDone <- err
+	}()
+
+	dstErr := dstProc.Wait()
+	if dstErr != nil {
+		// dst won't consume any more input, so stop src rather than leave it
+		// blocked writing into a pipe nobody is draining.
+		cancelSrc()
+	}
+	_ = pr.CloseWithError(io.ErrClosedPipe)
+	srcErr := <-srcDone
+
+	n := counter.Count()
+	switch {
+	case srcErr != nil && dstErr != nil:
+		// src is stopped once dst fails, so dst's failure is taken as the
+		// cause.
+		err := fmt.Errorf("%s\n%s", src.wrap(srcErr), dst.wrap(dstErr))
+		if dst.class != nil {
+			err = classify(dst.class, err)
+		}
+		return n, err
+	case srcErr != nil:
+		return n, src.wrap(srcErr)
+	case dstErr != nil:
+		return n, dst.wrap(dstErr)
+	}
+
+	return n, nil
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n atomic.Int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// Count returns the number of bytes written so far.
+func (c *countingWriter) Count() int64 {
+	return c.n.Load()
+}
+
+// stderrTailLines is the number of trailing stderr lines retained for error
+// reporting.
+const stderrTailLines = 20
+
+// outputLogger is an io.Writer that logs each complete line written to it and
+// retains the most recent lines so they can be surfaced on failure. Every line
+// is also recorded in the --log-file, if one is open.
+type outputLogger struct {
+	mu       sync.Mutex
+	prefix   string
+	maxLines int
+	partial  []byte
+	tail     []string
+	// quiet loggers only record to the --log-file.
+	quiet bool
+}
+
+func newOutputLogger(prefix string, maxLines int) *outputLogger {
+	return &outputLogger{prefix: prefix, maxLines: maxLines}
+}
+
+func (o *outputLogger) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.partial = append(o.partial, p...)
+	for {
+		i := bytes.IndexByte(o.partial, '\n')
+		if i < 0 {
+			break
+		}
+		o.record(string(o.partial[:i]))
+		o.partial = o.partial[i+1:]
+	}
+
+	return len(p), nil
+}
+
+// Flush logs any trailing output that was not terminated by a newline.
+func (o *outputLogger) Flush() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if len(o.partial) > 0 {
+		o.record(string(o.partial))
+		o.partial = nil
+	}
+}
+
+// Tail returns the retained lines joined by newlines.
+func (o *outputLogger) Tail() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return strings.Join(o.tail, "\n")
+}
+
+// ErrorContext returns the retained lines starting from the last reported
+// database error, which includes the details psql prints about the failing
+// statement. It's empty when no error was reported.
+func (o *outputLogger) ErrorContext() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for i := len(o.tail) - 1; i >= 0; i-- {
+		if strings.Contains(o.tail[i], "ERROR:") {
+			return strings.Join(o.tail[i:], "\n")
+		}
+	}
+	return ""
+}
+
+// maxStatementLength bounds how much of a failed statement is quoted in an
+// error.
+const maxStatementLength = 500
+
+var (
+	// sqlstatePattern matches the error code psql prints with VERBOSITY set to
+	// verbose, e.g. "ERROR:  42P07: relation "t" already exists".
+	sqlstatePattern = regexp.MustCompile(`ERROR:\s+([0-9A-Z]{5}):`)
+	// statementPattern matches the line introducing the failed statement, as
+	// printed by psql --echo-errors and by pg_restore.
+	statementPattern = regexp.MustCompile(`(?:STATEMENT:|Command was:)\s+(.*)`)
+	// lockTimeoutPattern matches pg_dump giving up on a table's lock after
+	// --lock-wait-timeout, capturing the table.
+	lockTimeoutPattern = regexp.MustCompile(`(?is)canceling statement due to lock timeout.*query was: LOCK TABLE (.+?) IN ACCESS SHARE MODE`)
+	// messagePattern matches the prefix psql and pg_restore add to each
+	// message they print.
+	messagePattern = regexp.MustCompile(`^(?:psql:[^:]*:\d+: |pg_restore: )`)
+)
+
+// parseFailedStatement extracts the SQLSTATE and failing statement from the
+// error context of a psql or pg_restore failure. Either is empty when it
+// wasn't reported.
+func parseFailedStatement(detail string) (sqlstate, statement string) {
+	lines := strings.Split(detail, "\n")
+	if m := sqlstatePattern.FindStringSubmatch(lines[0]); m != nil {
+		sqlstate = m[1]
+	}
+
+	for i, line := range lines {
+		m := statementPattern.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		// Statements spanning several lines continue until the next message.
+		parts := []string{m[1]}
+		for _, next := range lines[i+1:] {
+			if messagePattern.MatchString(next) {
+				break
+			}
+			parts = append(parts, strings.TrimSpace(next))
+		}
+		statement = strings.TrimSpace(strings.Join(parts, " "))
+		break
+	}
+
+	if len(statement) > maxStatementLength {
+		statement = statement[:maxStatementLength] + "..."
+	}
+	return sqlstate, statement
+}
+
+// statementError is a command failure caused by a statement the database
+// rejected.
+type statementError struct {
+	sqlstate  string
+	statement string
+	err       error
+}
+
+func (e *statementError) Error() string {
+	msg := e.err.Error()
+	if e.sqlstate != "" {
+		msg += " (SQLSTATE " + e.sqlstate + ")"
+	}
+	if e.statement != "" {
+		msg += " in statement: " + e.statement
+	}
+	return msg
+}
+
+func (e *statementError) Unwrap() error {
+	return e.err
+}
+
+func (o *outputLogger) record(line string) {
+	line = strings.TrimRight(line, "\r")
+	commandLog.writeLine(o.prefix + line)
+	if o.quiet {
+		return
+	}
+	log.Println(o.prefix + line)
+
+	o.tail = append(o.tail, line)
+	if len(o.tail) > o.maxLines {
+		o.tail = o.tail[len(o.tail)-o.maxLines:]
+	}
+}
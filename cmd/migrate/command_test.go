@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestExecRunnerKillsCommandOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p, err := execRunner{}.Start(ctx, command{name: "sleep", args: []string{"60"}})
+	if err != nil {
+		t.Fatalf("failed to start sleep: %s", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- p.Wait() }()
+
+	start := time.Now()
+	cancel()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expected the cancelled command to fail")
+		}
+	case <-time.After(terminateGracePeriod + time.Second):
+		t.Fatalf("command still running %s after cancel", time.Since(start))
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// configFile is a parsed --config file. Keys are flag names, and the source
+// and target connection strings may be given too.
+//
+// The file is a subset of TOML: key = value pairs of strings, booleans,
+// integers and arrays of those, plus [owner-map] and [tablespace-map] tables
+// of OLD = "NEW" pairs. Comments start with #.
+type configFile struct {
+	path   string
+	source string
+	target string
+	values []configValue
+}
+
+// configValue is a single value for a flag, with the line it was read from.
+type configValue struct {
+	line  int
+	name  string
+	value string
+}
+
+// configTables are the flags that can be given as a table of OLD = "NEW"
+// pairs.
+var configTables = []string{"owner-map", "tablespace-map"}
+
+// loadConfig reads the config file at path, rejecting keys that don't name
+// one of flags.
+func loadConfig(path string, flags *flag.FlagSet) (*configFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	c := &configFile{path: path}
+	seen := map[string]bool{}
+	var table string
+	var pending string
+	var pendingLine int
+
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		n := lineNo
+
+		// Arrays may span several lines, so they're collected until the
+		// closing bracket.
+		if pending != "" {
+			pending += " " + line
+			if !strings.HasSuffix(line, "]") {
+				continue
+			}
+			line, n, pending = pending, pendingLine, ""
+		}
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && !strings.Contains(line, "=") {
+			table = strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(line, "["), "]"))
+			if !contains(configTables, table) {
+				return nil, fmt.Errorf("%s:%d: unknown table [%s]. expected one of %s", path, n, table, strings.Join(configTables, ", "))
+			}
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected key = value", path, n)
+		}
+		key, value = unquoteKey(strings.TrimSpace(key)), strings.TrimSpace(value)
+
+		if strings.HasPrefix(value, "[") && !strings.HasSuffix(value, "]") {
+			pending, pendingLine = line, n
+			continue
+		}
+		values, err := parseConfigValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s: %w", path, n, key, err)
+		}
+
+		if table != "" {
+			if len(values) != 1 {
+				return nil, fmt.Errorf("%s:%d: [%s] %s must be a single value", path, n, table, key)
+			}
+			c.values = append(c.values, configValue{line: n, name: table, value: key + "=" + values[0]})
+			continue
+		}
+
+		// Flag names are accepted with underscores too, as is usual in TOML.
+		name := strings.ReplaceAll(key, "_", "-")
+		if seen[name] {
+			return nil, fmt.Errorf("%s:%d: %s is set more than once", path, n, key)
+		}
+		seen[name] = true
+
+		switch name {
+		case "source", "target":
+			if len(values) != 1 {
+				return nil, fmt.Errorf("%s:%d: %s must be a single connection string", path, n, key)
+			}
+			if name == "source" {
+				c.source = values[0]
+			} else {
+				c.target = values[0]
+			}
+			continue
+		case "config":
+			return nil, fmt.Errorf("%s:%d: config files can't include other config files", path, n)
+		}
+
+		fl := flags.Lookup(name)
+		if fl == nil {
+			return nil, fmt.Errorf("%s:%d: unknown key %q", path, n, key)
+		}
+		if _, repeatable := fl.Value.(*stringSlice); !repeatable && len(values) != 1 {
+			return nil, fmt.Errorf("%s:%d: %s takes a single value", path, n, key)
+		}
+		for _, v := range values {
+			c.values = append(c.values, configValue{line: n, name: name, value: v})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	if pending != "" {
+		return nil, fmt.Errorf("%s:%d: unterminated array", path, pendingLine)
+	}
+
+	return c, nil
+}
+
+// apply sets each flag in the file that wasn't given on the command line.
+// Flags set this way count as set, so the environment doesn't override them.
+func (c *configFile) apply(flags *flag.FlagSet) error {
+	set := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	for _, v := range c.values {
+		if set[v.name] {
+			continue
+		}
+		if err := flags.Set(v.name, v.value); err != nil {
+			return fmt.Errorf("%s:%d: invalid value %q for %s: %w", c.path, v.line, v.value, v.name, err)
+		}
+	}
+	return nil
+}
+
+// parseConfigValue parses a string, boolean, integer or array of those,
+// returning each value in the form its flag accepts.
+func parseConfigValue(value string) ([]string, error) {
+	if !strings.HasPrefix(value, "[") {
+		v, err := parseConfigScalar(value)
+		if err != nil {
+			return nil, err
+		}
+		return []string{v}, nil
+	}
+
+	var values []string
+	rest := strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(value, "["), "]"))
+	for rest != "" {
+		item, remaining, err := nextArrayItem(rest)
+		if err != nil {
+			return nil, err
+		}
+		v, err := parseConfigScalar(item)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+		rest = remaining
+	}
+	return values, nil
+}
+
+// nextArrayItem splits the first item off a comma-separated array body.
+func nextArrayItem(s string) (item, rest string, err error) {
+	end := len(s)
+	if s[0] == '"' || s[0] == '\'' {
+		quote := s[0]
+		i := 1
+		for ; i < len(s) && s[i] != quote; i++ {
+			if quote == '"' && s[i] == '\\' {
+				i++
+			}
+		}
+		if i >= len(s) {
+			return "", "", fmt.Errorf("unterminated string")
+		}
+		end = i + 1
+		if after := strings.TrimSpace(s[end:]); after != "" && after[0] != ',' {
+			return "", "", fmt.Errorf("expected , after %s", s[:end])
+		}
+	} else if i := strings.IndexByte(s, ','); i >= 0 {
+		end = i
+	}
+
+	item = strings.TrimSpace(s[:end])
+	rest = strings.TrimSpace(s[end:])
+	rest = strings.TrimSpace(strings.TrimPrefix(rest, ","))
+	return item, rest, nil
+}
+
+func parseConfigScalar(value string) (string, error) {
+	switch {
+	case value == "":
+		return "", fmt.Errorf("missing value")
+	case strings.HasPrefix(value, `"`):
+		v, err := strconv.Unquote(value)
+		if err != nil {
+			return "", fmt.Errorf("invalid string %s", value)
+		}
+		return v, nil
+	case strings.HasPrefix(value, "'"):
+		if len(value) < 2 || !strings.HasSuffix(value, "'") {
+			return "", fmt.Errorf("invalid string %s", value)
+		}
+		return value[1 : len(value)-1], nil
+	case value == "true", value == "false":
+		return value, nil
+	}
+	if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+		return "", fmt.Errorf("invalid value %s. strings must be quoted", value)
+	}
+	return value, nil
+}
+
+// unquoteKey strips the quotes from a quoted key, as used for role names
+// that aren't bare words.
+func unquoteKey(key string) string {
+	if v, err := parseConfigScalar(key); err == nil && (strings.HasPrefix(key, `"`) || strings.HasPrefix(key, "'")) {
+		return v
+	}
+	return key
+}
+
+// stripComment removes a trailing # comment from line, ignoring any # within
+// a string.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// confirmClean asks the operator to confirm a --clean import by typing the name
+// of the database whose objects will be dropped. Non-interactive sessions must
+// opt in with --yes since there is nobody to answer the prompt.
+func confirmClean(opts migrationOpts) error {
+	host, database, err := cleanTarget(opts)
+	if err != nil {
+		return err
+	}
+
+	if !isInteractive() {
+		return fmt.Errorf("--clean will drop objects in database %q on %s. re-run with --yes to confirm when not attached to a terminal", database, host)
+	}
+
+	fmt.Printf("--clean will drop objects in database %q on %s.\n", database, host)
+	fmt.Print("Type the database name to continue: ")
+
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("failed to read confirmation: %w", err)
+	}
+
+	if strings.TrimSpace(answer) != database {
+		return fmt.Errorf("confirmation did not match %q, aborting", database)
+	}
+
+	return nil
+}
+
+// cleanTarget resolves the host and database that a --clean import will drop
+// objects from. With --create, pg_dump drops and recreates the source database
+// by name on the target, rather than the database the target URI points at.
+func cleanTarget(opts migrationOpts) (string, string, error) {
+	targetConf, err := pgx.ParseConfig(opts.targetURI)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to parse target uri: %w", err)
+	}
+
+	database := targetConf.Database
+	if database == "" {
+		database = targetConf.User
+	}
+
+	if opts.create {
+		sourceConf, err := pgx.ParseConfig(opts.sourceURI)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to parse source uri: %w", err)
+		}
+		database = sourceConf.Database
+	}
+
+	return targetConf.Host, database, nil
+}
+
+// isInteractive reports whether both stdin and stdout are attached to a
+// terminal.
+func isInteractive() bool {
+	for _, f := range []*os.File{os.Stdin, os.Stdout} {
+		info, err := f.Stat()
+		if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+			return false
+		}
+	}
+	return true
+}
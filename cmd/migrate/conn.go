@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// ConnOpener opens connections to the source and target databases. The
+// default pgxOpener connects with pgx, while tests can substitute a fake.
+type ConnOpener interface {
+	Open(ctx context.Context, uri string) (dbConn, error)
+}
+
+// dbConn is the subset of *pgx.Conn used by the importer.
+type dbConn interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+	Begin(ctx context.Context) (pgx.Tx, error)
+	Config() *pgx.ConnConfig
+	PgConn() *pgconn.PgConn
+	Close(ctx context.Context) error
+}
+
+// pgxOpener opens pgx connections, retrying transient failures.
+type pgxOpener struct {
+	opts connectOpts
+}
+
+func (o pgxOpener) Open(ctx context.Context, uri string) (dbConn, error) {
+	conn, err := openConnection(ctx, uri, o.opts)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// connectOpts controls how connections to source and target are established.
+type connectOpts struct {
+	// retries is the number of additional attempts made after a retryable
+	// failure, with retryDelay doubling between each of them.
+	retries    int
+	retryDelay time.Duration
+
+	// timeout bounds dialing the server. The connection as a whole, including
+	// TLS negotiation and authentication, may take up to twice as long.
+	timeout time.Duration
+}
+
+func openConnection(parentCtx context.Context, uri string, opts connectOpts) (*pgx.Conn, error) {
+	conf, err := pgx.ParseConfig(uri)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse uri: %w", err)
+	}
+
+	conf.ConnectTimeout = opts.timeout
+
+	delay := opts.retryDelay
+	for attempt := 0; ; attempt++ {
+		conn, err := connect(parentCtx, conf, 2*opts.timeout)
+		if err == nil {
+			return conn, nil
+		}
+
+		if attempt >= opts.retries || !isRetryableConnectError(err) || parentCtx.Err() != nil {
+			return nil, err
+		}
+
+		log.Printf("[info] Connection to %s failed, retrying in %s (%d/%d): %s", conf.Host, delay, attempt+1, opts.retries, err)
+
+		select {
+		case <-time.After(delay):
+		case <-parentCtx.Done():
+			return nil, parentCtx.Err()
+		}
+		delay *= 2
+	}
+}
+
+func connect(parentCtx context.Context, conf *pgx.ConnConfig, timeout time.Duration) (*pgx.Conn, error) {
+	ctx, cancel := context.WithTimeout(parentCtx, timeout)
+	defer cancel()
+
+	return pgx.ConnectConfig(ctx, conf)
+}
+
+// sslOpts overrides the TLS settings of the source and target connection
+// strings. Empty fields leave the setting in the connection string as is.
+type sslOpts struct {
+	mode     string
+	rootCert string
+	cert     string
+	key      string
+}
+
+// sslModes are the sslmode values libpq accepts, from least to most secure.
+var sslModes = []string{"disable", "allow", "prefer", "require", "verify-ca", "verify-full"}
+
+// withSSL returns uri with the settings in ssl applied. They're written into
+// the connection string rather than the PGSSL* environment variables, which
+// libpq only consults for settings the connection string leaves out.
+func withSSL(uri string, ssl sslOpts) (string, error) {
+	params := [][2]string{
+		{"sslmode", ssl.mode},
+		{"sslrootcert", ssl.rootCert},
+		{"sslcert", ssl.cert},
+		{"sslkey", ssl.key},
+	}
+
+	if strings.HasPrefix(uri, "postgres://") || strings.HasPrefix(uri, "postgresql://") {
+		u, err := url.Parse(uri)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse uri: %w", err)
+		}
+		query := u.Query()
+		for _, p := range params {
+			if p[1] != "" {
+				query.Set(p[0], p[1])
+			}
+		}
+		u.RawQuery = query.Encode()
+		return u.String(), nil
+	}
+
+	// Later keywords take precedence over earlier ones.
+	quote := strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+	for _, p := range params {
+		if p[1] != "" {
+			uri += fmt.Sprintf(" %s='%s'", p[0], quote.Replace(p[1]))
+		}
+	}
+	return uri, nil
+}
+
+// checkSSL verifies the connection to the named server is encrypted.
+func checkSSL(ctx context.Context, conn dbConn, name string) error {
+	var encrypted bool
+	err := conn.QueryRow(ctx, "SELECT ssl FROM pg_stat_ssl WHERE pid = pg_backend_pid()").Scan(&encrypted)
+	if err != nil {
+		return fmt.Errorf("failed to query %s connection encryption: %w", name, err)
+	}
+	if !encrypted {
+		return fmt.Errorf("--require-ssl: the connection to the %s isn't encrypted", name)
+	}
+	return nil
+}
+
+// isUndefinedDatabase reports whether err is the server rejecting a connection
+// to a database that doesn't exist.
+func isUndefinedDatabase(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "3D000" // invalid_catalog_name
+}
+
+// isPreparedStatementError reports whether err is the server not knowing a
+// statement the connection prepared, or already knowing one it prepares, as
+// happens when a pooler moves the client between server connections.
+func isPreparedStatementError(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && (pgErr.Code == "26000" || pgErr.Code == "42P05") // invalid_sql_statement_name, duplicate_prepared_statement
+}
+
+// isLockTimeout reports whether err is a statement giving up on a lock after
+// lock_timeout.
+func isLockTimeout(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "55P03" // lock_not_available
+}
+
+// isRetryableConnectError reports whether a connection failure is likely to be
+// transient, such as a target that is still booting. Errors reported by the
+// server itself, like authentication failures or unknown databases, are fatal.
+func isRetryableConnectError(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case "57P03", "53300": // cannot_connect_now, too_many_connections
+			return true
+		}
+		return false
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, io.EOF)
+}
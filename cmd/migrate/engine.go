@@ -0,0 +1,618 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Supported import engines.
+const (
+	// enginePgDump pipes pg_dump into psql or pg_restore.
+	enginePgDump = "pg_dump"
+	// enginePgx copies tables in-process with COPY over pgx connections, so
+	// no client tools are needed.
+	enginePgx = "pgx"
+)
+
+// copyTable is a source table as recreated by the pgx engine.
+type copyTable struct {
+	oid      uint32
+	ref      tableRef
+	unlogged bool
+	// size is the table's size on disk, used to schedule the largest first.
+	size    int64
+	columns []copyColumn
+	// constraints are added once the data is loaded, except foreign keys,
+	// which wait until every table is loaded.
+	constraints []copyConstraint
+	// indexes are the CREATE INDEX statements for indexes not backing a
+	// constraint.
+	indexes []string
+}
+
+type copyColumn struct {
+	name     string
+	dataType string
+	notNull  bool
+	// def is the default expression, if any.
+	def string
+	// identity is attidentity: 'a' for ALWAYS, 'd' for BY DEFAULT.
+	identity string
+	// generated is the expression of a stored generated column.
+	generated string
+	// sequence is the serial sequence behind def, as returned by
+	// pg_get_serial_sequence.
+	sequence string
+}
+
+type copyConstraint struct {
+	name       string
+	foreignKey bool
+	def        string
+}
+
+// name returns the quoted, schema-qualified name of the table.
+func (t copyTable) name() string {
+	return pgx.Identifier{t.ref.schema, t.ref.name}.Sanitize()
+}
+
+// copyColumns returns the quoted columns COPY reads and writes. Generated
+// columns are computed by the target, so they're left out.
+func (t copyTable) copyColumns() string {
+	var names []string
+	for _, c := range t.columns {
+		if c.generated == "" {
+			names = append(names, pgx.Identifier{c.name}.Sanitize())
+		}
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(names, ", ") + ")"
+}
+
+// copyWithPgx imports the selected tables by introspecting them on the
+// source, creating them on the target and streaming their rows between the
+// two connections with COPY. Everything is read from a single source
+// transaction, so the tables are consistent with one another.
+func copyWithPgx(ctx context.Context, d deps, opts migrationOpts, total int64, result *migrationResult) error {
+	sourceConn, err := d.opener.Open(ctx, opts.sourceURI)
+	if err != nil {
+		return classify(ErrSourceUnreachable, fmt.Errorf("failed to connect to source: %w", err))
+	}
+	defer func() { _ = sourceConn.Close(context.Background()) }()
+
+	if err := beginSnapshot(ctx, sourceConn, opts); err != nil {
+		return err
+	}
+
+	tables, err := introspectTables(ctx, sourceConn, newTableFilter(opts))
+	if err != nil {
+		return fmt.Errorf("failed to introspect source tables: %w", err)
+	}
+	log.Printf("[info] Copying %d table(s) with the pgx engine", len(tables))
+
+	targetConn, err := openCopyTarget(ctx, d, opts)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = targetConn.Close(context.Background()) }()
+
+	if !opts.dataOnly {
+		if err := createTables(ctx, targetConn, tables); err != nil {
+			return classify(ErrRestoreFailed, err)
+		}
+	}
+
+	if !opts.schemaOnly {
+		stats := &copyStats{bytes: countingWriter{w: io.Discard}}
+		stop := startProgress(total, stats.bytes.Count)
+		stopMonitor := startCopyMonitor(ctx, d, opts)
+		err := copyTablesData(ctx, d, opts, sourceConn, targetConn, tables, stats)
+		stopMonitor()
+		stop()
+		if err != nil {
+			return classify(ErrRestoreFailed, err)
+		}
+
+		sort.Slice(stats.tables, func(i, j int) bool { return stats.tables[i].Table < stats.tables[j].Table })
+		result.Tables = len(stats.tables)
+		result.TableTimings = stats.tables
+		result.Bytes = stats.bytes.Count()
+		for _, t := range stats.tables {
+			result.Rows += t.Rows
+		}
+	}
+
+	if !opts.dataOnly {
+		if err := addConstraints(ctx, targetConn, tables); err != nil {
+			return classify(ErrRestoreFailed, err)
+		}
+	}
+
+	return nil
+}
+
+// openCopyTarget connects to the target for loading rows, with triggers
+// disabled under --disable-triggers and --fast-restore's settings applied.
+func openCopyTarget(ctx context.Context, d deps, opts migrationOpts) (dbConn, error) {
+	conn, err := d.opener.Open(ctx, opts.targetURI)
+	if err != nil {
+		return nil, classify(ErrTargetUnreachable, fmt.Errorf("failed to connect to target: %w", err))
+	}
+
+	if opts.disableTriggers {
+		if _, err := conn.Exec(ctx, "SET session_replication_role = replica"); err != nil {
+			_ = conn.Close(ctx)
+			return nil, fmt.Errorf("failed to disable triggers: %w", err)
+		}
+	}
+	if opts.fastRestore {
+		for _, setting := range fastRestoreSettings {
+			if _, err := conn.Exec(ctx, "SELECT set_config($1, $2, false)", setting[0], setting[1]); err != nil {
+				_ = conn.Close(ctx)
+				return nil, fmt.Errorf("failed to set %s: %w", setting[0], err)
+			}
+		}
+	}
+	return conn, nil
+}
+
+// beginSnapshot opens the read-only transaction the source is copied from,
+// honoring --snapshot and --serializable-deferrable as pg_dump would.
+func beginSnapshot(ctx context.Context, conn dbConn, opts migrationOpts) error {
+	begin := "BEGIN ISOLATION LEVEL REPEATABLE READ, READ ONLY"
+	switch {
+	case opts.serializableDeferrable && opts.snapshot != "":
+		// Deferrable transactions can't import a snapshot, so parallel workers
+		// join the leader's with a plain serializable one, as pg_dump's do.
+		begin = "BEGIN ISOLATION LEVEL SERIALIZABLE, READ ONLY"
+	case opts.serializableDeferrable:
+		begin = "BEGIN ISOLATION LEVEL SERIALIZABLE, READ ONLY, DEFERRABLE"
+	}
+	if _, err := conn.Exec(ctx, begin); err != nil {
+		return fmt.Errorf("failed to begin source transaction: %w", err)
+	}
+	if opts.snapshot != "" {
+		if _, err := conn.Exec(ctx, "SET TRANSACTION SNAPSHOT "+quoteLiteral(opts.snapshot)); err != nil {
+			return fmt.Errorf("failed to import snapshot %s: %w", opts.snapshot, err)
+		}
+	}
+	// As with pg_dump, restricting the search path to pg_catalog makes the
+	// introspected definitions schema-qualify every other name, so they
+	// resolve the same way on the target.
+	if _, err := conn.Exec(ctx, "SET LOCAL search_path = pg_catalog"); err != nil {
+		return fmt.Errorf("failed to set source search_path: %w", err)
+	}
+	if opts.lockWaitTimeout > 0 {
+		if _, err := conn.Exec(ctx, fmt.Sprintf("SET LOCAL lock_timeout = %d", opts.lockWaitTimeout.Milliseconds())); err != nil {
+			return fmt.Errorf("failed to set source lock_timeout: %w", err)
+		}
+	}
+	return nil
+}
+
+// introspectTables reads the definitions of the source tables selected by
+// filter, excluding those belonging to extensions.
+func introspectTables(ctx context.Context, conn dbConn, filter tableFilter) ([]copyTable, error) {
+	var version int
+	if err := conn.QueryRow(ctx, "SELECT current_setting('server_version_num')::int").Scan(&version); err != nil {
+		return nil, err
+	}
+
+	rows, err := conn.Query(ctx, `SELECT c.oid, n.nspname, c.relname, c.relkind::text, c.relpersistence = 'u', pg_table_size(c.oid)
+		FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind IN ('r', 'p') AND c.relpersistence <> 't'
+		AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+		AND n.nspname NOT LIKE 'pg_toast%'
+		AND NOT EXISTS (SELECT 1 FROM pg_depend d
+			WHERE d.classid = 'pg_class'::regclass AND d.objid = c.oid AND d.deptype = 'e')
+		ORDER BY 2, 3`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tables []copyTable
+	var partitioned []string
+	for rows.Next() {
+		var t copyTable
+		var kind string
+		if err := rows.Scan(&t.oid, &t.ref.schema, &t.ref.name, &kind, &t.unlogged, &t.size); err != nil {
+			return nil, err
+		}
+		if !filter.includesTable(t.ref) {
+			continue
+		}
+		if kind == "p" {
+			partitioned = append(partitioned, t.ref.String())
+			continue
+		}
+		tables = append(tables, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	if len(partitioned) > 0 {
+		return nil, fmt.Errorf("partitioned tables aren't supported by --engine=pgx yet: %s", abbreviateList(partitioned))
+	}
+
+	for i := range tables {
+		t := &tables[i]
+		if t.columns, err = introspectColumns(ctx, conn, t.oid, version); err != nil {
+			return nil, fmt.Errorf("%s: %w", t.ref, err)
+		}
+		if t.constraints, err = introspectConstraints(ctx, conn, t.oid); err != nil {
+			return nil, fmt.Errorf("%s: %w", t.ref, err)
+		}
+		if t.indexes, err = introspectIndexes(ctx, conn, t.oid); err != nil {
+			return nil, fmt.Errorf("%s: %w", t.ref, err)
+		}
+	}
+
+	return tables, nil
+}
+
+func introspectColumns(ctx context.Context, conn dbConn, oid uint32, version int) ([]copyColumn, error) {
+	// Identity columns arrived in Postgres 10 and generated columns in 12.
+	identity, generated := "''", "''"
+	if version >= 100000 {
+		identity = "a.attidentity::text"
+	}
+	if version >= 120000 {
+		generated = "a.attgenerated::text"
+	}
+
+	rows, err := conn.Query(ctx, `SELECT a.attname, format_type(a.atttypid, a.atttypmod), a.attnotnull,
+			coalesce(pg_get_expr(d.adbin, d.adrelid), ''), `+identity+`, `+generated+`,
+			coalesce(pg_get_serial_sequence(a.attrelid::regclass::text, a.attname), '')
+		FROM pg_attribute a
+		LEFT JOIN pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum
+		WHERE a.attrelid = $1 AND a.attnum > 0 AND NOT a.attisdropped
+		ORDER BY a.attnum`, oid)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (copyColumn, error) {
+		var c copyColumn
+		var generatedKind string
+		if err := row.Scan(&c.name, &c.dataType, &c.notNull, &c.def, &c.identity, &generatedKind, &c.sequence); err != nil {
+			return c, err
+		}
+		if generatedKind == "s" {
+			c.generated, c.def = c.def, ""
+		}
+		// Identity columns create their own sequence.
+		if c.identity != "" {
+			c.def, c.sequence = "", ""
+		}
+		return c, nil
+	})
+}
+
+func introspectConstraints(ctx context.Context, conn dbConn, oid uint32) ([]copyConstraint, error) {
+	rows, err := conn.Query(ctx, `SELECT conname, contype = 'f', pg_get_constraintdef(oid)
+		FROM pg_constraint
+		WHERE conrelid = $1 AND contype IN ('p', 'u', 'c', 'x', 'f')
+		ORDER BY conname`, oid)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (copyConstraint, error) {
+		var c copyConstraint
+		err := row.Scan(&c.name, &c.foreignKey, &c.def)
+		return c, err
+	})
+}
+
+func introspectIndexes(ctx context.Context, conn dbConn, oid uint32) ([]string, error) {
+	rows, err := conn.Query(ctx, `SELECT pg_get_indexdef(i.indexrelid)
+		FROM pg_index i
+		WHERE i.indrelid = $1
+		AND NOT EXISTS (SELECT 1 FROM pg_constraint c WHERE c.conindid = i.indexrelid AND c.contype IN ('p', 'u', 'x'))
+		ORDER BY i.indexrelid`, oid)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+// createTables creates the schemas, serial sequences and tables on the
+// target, without constraints or indexes, so rows load as quickly as
+// possible.
+func createTables(ctx context.Context, conn dbConn, tables []copyTable) error {
+	var schemas []string
+	for _, t := range tables {
+		if !contains(schemas, t.ref.schema) {
+			schemas = append(schemas, t.ref.schema)
+		}
+	}
+	sort.Strings(schemas)
+	for _, schema := range schemas {
+		if _, err := conn.Exec(ctx, "CREATE SCHEMA IF NOT EXISTS "+pgx.Identifier{schema}.Sanitize()); err != nil {
+			return fmt.Errorf("failed to create schema %s: %w", schema, err)
+		}
+	}
+
+	for _, t := range tables {
+		for _, c := range t.columns {
+			if c.sequence == "" {
+				continue
+			}
+			if _, err := conn.Exec(ctx, "CREATE SEQUENCE IF NOT EXISTS "+c.sequence); err != nil {
+				return fmt.Errorf("failed to create sequence %s: %w", c.sequence, err)
+			}
+		}
+
+		if _, err := conn.Exec(ctx, createTableSQL(t)); err != nil {
+			return fmt.Errorf("failed to create table %s: %w", t.ref, err)
+		}
+
+		for _, c := range t.columns {
+			if c.sequence == "" {
+				continue
+			}
+			sql := fmt.Sprintf("ALTER SEQUENCE %s OWNED BY %s.%s", c.sequence, t.name(), pgx.Identifier{c.name}.Sanitize())
+			if _, err := conn.Exec(ctx, sql); err != nil {
+				return fmt.Errorf("failed to attach sequence %s: %w", c.sequence, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// createTableSQL returns the CREATE TABLE statement for t's columns.
+func createTableSQL(t copyTable) string {
+	var columns []string
+	for _, c := range t.columns {
+		column := pgx.Identifier{c.name}.Sanitize() + " " + c.dataType
+		switch {
+		case c.generated != "":
+			column += " GENERATED ALWAYS AS (" + c.generated + ") STORED"
+		case c.identity == "a":
+			column += " GENERATED ALWAYS AS IDENTITY"
+		case c.identity == "d":
+			column += " GENERATED BY DEFAULT AS IDENTITY"
+		case c.def != "":
+			column += " DEFAULT " + c.def
+		}
+		if c.notNull {
+			column += " NOT NULL"
+		}
+		columns = append(columns, column)
+	}
+
+	create := "CREATE TABLE "
+	if t.unlogged {
+		create = "CREATE UNLOGGED TABLE "
+	}
+	return create + t.name() + " (\n    " + strings.Join(columns, ",\n    ") + "\n)"
+}
+
+// copyStats accumulates what the pgx engine has copied, across workers.
+type copyStats struct {
+	bytes countingWriter
+
+	mu     sync.Mutex
+	tables []tableTiming
+}
+
+func (s *copyStats) add(t tableTiming) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tables = append(s.tables, t)
+}
+
+// copyTablesData streams the rows of each table from source to target,
+// recording what was copied in stats. With --jobs, tables are copied
+// concurrently by a pool of workers, each with its own connections, reading
+// from the source transaction's snapshot. --max-rate caps the workers'
+// combined rate.
+func copyTablesData(ctx context.Context, d deps, opts migrationOpts, source, target dbConn, tables []copyTable, stats *copyStats) error {
+	start := time.Now()
+	var limiter *rateLimiter
+	if opts.maxRate > 0 {
+		limiter = newRateLimiter(opts.maxRate)
+	}
+	jobs := opts.jobs
+	if jobs > len(tables) {
+		jobs = len(tables)
+	}
+
+	if jobs <= 1 {
+		for _, t := range tables {
+			if err := copyTableLogged(ctx, source, target, t, limiter, stats); err != nil {
+				return err
+			}
+		}
+	} else if err := copyTablesParallel(ctx, d, opts, source, tables, jobs, limiter, stats); err != nil {
+		return err
+	}
+
+	elapsed := time.Since(start)
+	var rate int64
+	if elapsed > 0 {
+		rate = int64(float64(stats.bytes.Count()) / elapsed.Seconds())
+	}
+	log.Printf("[info] Copied %s from %d table(s) in %s (%s/s)", formatBytes(stats.bytes.Count()), len(tables), elapsed.Round(time.Second), formatBytes(rate))
+	return nil
+}
+
+// copyTablesParallel copies tables with a pool of jobs workers. Constraints
+// are only added once every table is loaded, and --data-only loads require
+// --disable-triggers, so tables can be copied in any order. The largest are
+// started first, so a large table copied last doesn't hold up the import
+// alone. Rows are streamed through each worker without being buffered, so
+// memory use doesn't grow with the size of the tables.
+func copyTablesParallel(ctx context.Context, d deps, opts migrationOpts, source dbConn, tables []copyTable, jobs int, limiter *rateLimiter, stats *copyStats) error {
+	snapshot := opts.snapshot
+	if snapshot == "" {
+		if err := source.QueryRow(ctx, "SELECT pg_export_snapshot()").Scan(&snapshot); err != nil {
+			return fmt.Errorf("failed to export source snapshot: %w", err)
+		}
+	}
+	workerOpts := opts
+	workerOpts.snapshot = snapshot
+
+	queue := make([]copyTable, len(tables))
+	copy(queue, tables)
+	sort.SliceStable(queue, func(i, j int) bool { return queue[i].size > queue[j].size })
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	log.Printf("[info] Copying tables with %d workers", jobs)
+	pending := make(chan copyTable)
+	errs := make(chan error, jobs)
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := copyWorker(ctx, d, workerOpts, pending, limiter, stats); err != nil {
+				errs <- err
+				// Stops the other workers, as the import has failed.
+				cancel()
+			}
+		}()
+	}
+
+feed:
+	for _, t := range queue {
+		select {
+		case pending <- t:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(pending)
+	wg.Wait()
+	close(errs)
+
+	// The first error is the cause, later ones are the other workers being
+	// cancelled.
+	if err := <-errs; err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// copyWorker copies the tables it receives over its own source and target
+// connections until pending is closed.
+func copyWorker(ctx context.Context, d deps, opts migrationOpts, pending <-chan copyTable, limiter *rateLimiter, stats *copyStats) error {
+	source, err := d.opener.Open(ctx, opts.sourceURI)
+	if err != nil {
+		return classify(ErrSourceUnreachable, fmt.Errorf("failed to connect to source: %w", err))
+	}
+	defer func() { _ = source.Close(context.Background()) }()
+
+	if err := beginSnapshot(ctx, source, opts); err != nil {
+		return err
+	}
+
+	target, err := openCopyTarget(ctx, d, opts)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = target.Close(context.Background()) }()
+
+	for t := range pending {
+		if err := copyTableLogged(ctx, source, target, t, limiter, stats); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyTableLogged copies a single table, logging and recording its row count,
+// size and how long it took. Rows are read no faster than limiter allows.
+func copyTableLogged(ctx context.Context, source, target dbConn, t copyTable, limiter *rateLimiter, stats *copyStats) error {
+	start := time.Now()
+	table := &countingWriter{w: &stats.bytes}
+	rows, err := copyTableData(ctx, source, target, t, func(w io.Writer) io.Writer {
+		return limiter.limit(io.MultiWriter(w, table))
+	})
+	if isLockTimeout(err) {
+		return fmt.Errorf("could not acquire lock on %s: %w", t.ref, err)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to copy %s: %w", t.ref, err)
+	}
+	elapsed := time.Since(start)
+	log.Printf("[info] Copied %s: %d rows, %s in %s", t.ref, rows, formatBytes(table.Count()), elapsed.Round(time.Millisecond))
+	stats.add(tableTiming{Table: t.ref.String(), Rows: rows, Bytes: table.Count(), Duration: elapsed.Seconds()})
+	return nil
+}
+
+// copyTableData pipes COPY TO STDOUT on the source into COPY FROM STDIN on
+// the target, returning the number of rows loaded. output wraps the writer
+// the source's rows are written to.
+func copyTableData(ctx context.Context, source, target dbConn, t copyTable, output func(io.Writer) io.Writer) (int64, error) {
+	columns := t.copyColumns()
+	r, w := io.Pipe()
+
+	copied := make(chan error, 1)
+	go func() {
+		_, err := source.PgConn().CopyTo(ctx, output(w), "COPY "+t.name()+columns+" TO STDOUT")
+		_ = w.CloseWithError(err)
+		copied <- err
+	}()
+
+	tag, err := target.PgConn().CopyFrom(ctx, r, "COPY "+t.name()+columns+" FROM STDIN")
+	// Unblocks the source when the target gave up partway through.
+	_ = r.CloseWithError(io.ErrClosedPipe)
+	if sourceErr := <-copied; sourceErr != nil && err == nil {
+		err = fmt.Errorf("failed to read from source: %w", sourceErr)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return tag.RowsAffected(), nil
+}
+
+// addConstraints adds the constraints and indexes of each table once its rows
+// are loaded. Foreign keys come last, as they may reference any table.
+func addConstraints(ctx context.Context, conn dbConn, tables []copyTable) error {
+	log.Println("[info] Creating constraints and indexes...")
+	var foreignKeys []string
+	for _, t := range tables {
+		for _, c := range t.constraints {
+			sql := fmt.Sprintf("ALTER TABLE %s ADD CONSTRAINT %s %s", t.name(), pgx.Identifier{c.name}.Sanitize(), c.def)
+			if c.foreignKey {
+				foreignKeys = append(foreignKeys, sql)
+				continue
+			}
+			if _, err := conn.Exec(ctx, sql); err != nil {
+				return fmt.Errorf("failed to add constraint %s on %s: %w", c.name, t.ref, err)
+			}
+		}
+
+		for _, sql := range t.indexes {
+			if _, err := conn.Exec(ctx, sql); err != nil {
+				return fmt.Errorf("failed to create index on %s: %w", t.ref, err)
+			}
+		}
+	}
+
+	for _, sql := range foreignKeys {
+		if _, err := conn.Exec(ctx, sql); err != nil {
+			return fmt.Errorf("failed to add foreign key: %w", err)
+		}
+	}
+
+	return nil
+}
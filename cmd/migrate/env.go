@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// envPrefix is prepended to a flag's name to form the environment variable
+// it can be set with, e.g. PGIMPORT_NO_OWNER for --no-owner.
+const envPrefix = "PGIMPORT_"
+
+// envName returns the environment variable that sets the named flag.
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// applyEnvFlags sets each flag that wasn't given on the command line from its
+// environment variable, if that's set. Repeatable flags take a
+// comma-separated list.
+func applyEnvFlags(flags *flag.FlagSet, getenv func(string) string) error {
+	set := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[f.Name] {
+			return
+		}
+		value := getenv(envName(f.Name))
+		if value == "" {
+			return
+		}
+
+		values := []string{value}
+		if _, ok := f.Value.(*stringSlice); ok {
+			values = strings.Split(value, ",")
+		}
+		for _, v := range values {
+			if setErr := f.Value.Set(strings.TrimSpace(v)); setErr != nil {
+				err = fmt.Errorf("invalid value %q for %s: %w", value, envName(f.Name), setErr)
+				return
+			}
+		}
+	})
+	return err
+}
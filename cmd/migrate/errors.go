@@ -0,0 +1,42 @@
+package main
+
+import "errors"
+
+// Classes of failure returned by runPreChecks and runMigration. Errors are
+// matched against them with errors.Is, while their messages still describe
+// the specific failure.
+var (
+	ErrSourceUnreachable   = errors.New("source unreachable")
+	ErrTargetUnreachable   = errors.New("target unreachable")
+	ErrVersionIncompatible = errors.New("version incompatible")
+	ErrTargetNotEmpty      = errors.New("target not empty")
+	ErrDumpFailed          = errors.New("dump failed")
+	ErrRestoreFailed       = errors.New("restore failed")
+	ErrVerifyFailed        = errors.New("verification failed")
+)
+
+// classifiedError places err in one of the classes of failure above.
+type classifiedError struct {
+	class error
+	err   error
+}
+
+func (e *classifiedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classifiedError) Unwrap() error {
+	return e.err
+}
+
+func (e *classifiedError) Is(target error) bool {
+	return target == e.class
+}
+
+// classify places err in class. A nil err is returned as is.
+func classify(class, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &classifiedError{class: class, err: err}
+}
@@ -0,0 +1,44 @@
+package main
+
+import "errors"
+
+// Exit codes reported for each class of failure, so automation can tell
+// retryable failures apart from ones that need a change before trying again.
+const (
+	// exitFailure covers any failure not classified below.
+	exitFailure = 1
+	// exitUsage is returned for invalid flags or environment.
+	exitUsage = 2
+	// exitConnectivity is returned when the source or target can't be reached.
+	exitConnectivity = 3
+	// exitIncompatible is returned when the servers or client tools are
+	// running versions that can't be migrated between.
+	exitIncompatible = 4
+	// exitRestore is returned when the dump failed to restore into the target.
+	exitRestore = 5
+	// exitVerify is returned when the target's row counts don't match the
+	// source's after the import.
+	exitVerify = 6
+	// exitDump is returned when pg_dump failed to dump the source.
+	exitDump = 7
+	// exitTimeout is returned when the import exceeded --timeout, as timeout(1)
+	// does.
+	exitTimeout = 124
+)
+
+// exitCode returns the code the process should exit with for err.
+func exitCode(err error) int {
+	switch {
+	case errors.Is(err, ErrSourceUnreachable), errors.Is(err, ErrTargetUnreachable):
+		return exitConnectivity
+	case errors.Is(err, ErrVersionIncompatible):
+		return exitIncompatible
+	case errors.Is(err, ErrDumpFailed):
+		return exitDump
+	case errors.Is(err, ErrRestoreFailed):
+		return exitRestore
+	case errors.Is(err, ErrVerifyFailed):
+		return exitVerify
+	}
+	return exitFailure
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+// Settings applied to the target by --fast-restore.
+const (
+	// fastRestoreMaintenanceWorkMem speeds up index and foreign key builds.
+	// It's allocated per restore job, so it's kept modest for small machines.
+	fastRestoreMaintenanceWorkMem = "512MB"
+	// fastRestoreMaxWALSize spaces out the checkpoints a bulk load triggers.
+	fastRestoreMaxWALSize = "16GB"
+)
+
+// fastRestoreSettings are the session settings --fast-restore applies to each
+// restore connection. They last only as long as the session, so they don't
+// need restoring. Losing the restore's most recent commits to a crash is
+// harmless, as the import would be rerun anyway.
+var fastRestoreSettings = [][2]string{
+	{"maintenance_work_mem", fastRestoreMaintenanceWorkMem},
+	{"synchronous_commit", "off"},
+}
+
+// raiseMaxWALSize raises max_wal_size on the target for the duration of the
+// restore. It can only be changed server-wide, which requires a superuser, so
+// it's skipped with a warning otherwise. The returned function puts back the
+// previous setting.
+func raiseMaxWALSize(ctx context.Context, d deps, opts migrationOpts) (restore func(), err error) {
+	conn, err := d.opener.Open(ctx, opts.targetURI)
+	if err != nil {
+		return nil, classify(ErrTargetUnreachable, fmt.Errorf("failed to connect to target: %w", err))
+	}
+	defer func() { _ = conn.Close(ctx) }()
+
+	var superuser bool
+	var current string
+	// A previous ALTER SYSTEM is recorded in postgresql.auto.conf, and is put
+	// back rather than reset.
+	var altered bool
+	err = conn.QueryRow(ctx, `SELECT r.rolsuper, s.setting || coalesce(s.unit, ''),
+			coalesce(s.sourcefile LIKE '%postgresql.auto.conf', false)
+		FROM pg_roles r, pg_settings s
+		WHERE r.rolname = current_user AND s.name = 'max_wal_size'`).Scan(&superuser, &current, &altered)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query max_wal_size: %w", err)
+	}
+	if !superuser {
+		log.Printf("[warn] --fast-restore can't raise max_wal_size, as the target user %q isn't a superuser", conn.Config().User)
+		return func() {}, nil
+	}
+
+	if err := setMaxWALSize(ctx, conn, fastRestoreMaxWALSize); err != nil {
+		return nil, err
+	}
+	log.Printf("[info] Raised max_wal_size on the target from %s to %s for the restore", current, fastRestoreMaxWALSize)
+
+	return func() {
+		// The import's context may have been cancelled by now.
+		ctx := context.Background()
+		conn, err := d.opener.Open(ctx, opts.targetURI)
+		if err == nil {
+			defer func() { _ = conn.Close(ctx) }()
+			previous := ""
+			if altered {
+				previous = current
+			}
+			err = setMaxWALSize(ctx, conn, previous)
+		}
+		if err != nil {
+			log.Printf("[warn] failed to restore max_wal_size on the target, run ALTER SYSTEM RESET max_wal_size by hand: %s", err)
+			return
+		}
+		log.Printf("[info] Restored max_wal_size on the target to %s", current)
+	}, nil
+}
+
+// setMaxWALSize changes max_wal_size server-wide, resetting it to the
+// configuration file's value when value is empty.
+func setMaxWALSize(ctx context.Context, conn dbConn, value string) error {
+	sql := "ALTER SYSTEM RESET max_wal_size"
+	if value != "" {
+		sql = "ALTER SYSTEM SET max_wal_size = " + quoteLiteral(value)
+	}
+	if _, err := conn.Exec(ctx, sql); err != nil {
+		return fmt.Errorf("failed to set max_wal_size: %w", err)
+	}
+	if _, err := conn.Exec(ctx, "SELECT pg_reload_conf()"); err != nil {
+		return fmt.Errorf("failed to reload target configuration: %w", err)
+	}
+	return nil
+}
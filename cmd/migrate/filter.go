@@ -0,0 +1,148 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// tableRef identifies a table by schema and name.
+type tableRef struct {
+	schema string
+	name   string
+}
+
+func (t tableRef) String() string {
+	return t.schema + "." + t.name
+}
+
+// tableFilter approximates pg_dump's object selection so post-migration steps
+// only consider the objects that were actually dumped.
+type tableFilter struct {
+	schemas        []*regexp.Regexp
+	excludeSchemas []*regexp.Regexp
+	tables         []qualifiedPattern
+	excludeTables  []qualifiedPattern
+}
+
+// qualifiedPattern is a table pattern split on its schema separator. A nil
+// schema matches tables in any schema.
+type qualifiedPattern struct {
+	schema *regexp.Regexp
+	name   *regexp.Regexp
+}
+
+func (p qualifiedPattern) match(t tableRef) bool {
+	if p.schema != nil && !p.schema.MatchString(t.schema) {
+		return false
+	}
+	return p.name.MatchString(t.name)
+}
+
+func newTableFilter(opts migrationOpts) tableFilter {
+	var f tableFilter
+	for _, pattern := range opts.schemas {
+		f.schemas = append(f.schemas, compilePattern(pattern))
+	}
+	for _, pattern := range opts.excludeSchemas {
+		f.excludeSchemas = append(f.excludeSchemas, compilePattern(pattern))
+	}
+	for _, pattern := range opts.tables {
+		f.tables = append(f.tables, compileQualifiedPattern(pattern))
+	}
+	for _, pattern := range opts.excludeTables {
+		f.excludeTables = append(f.excludeTables, compileQualifiedPattern(pattern))
+	}
+	return f
+}
+
+// includesSchema reports whether objects within the schema are dumped.
+func (f tableFilter) includesSchema(schema string) bool {
+	if len(f.schemas) > 0 && !matchAny(f.schemas, schema) {
+		return false
+	}
+	return !matchAny(f.excludeSchemas, schema)
+}
+
+// includesTable reports whether the table is dumped. As with pg_dump, schema
+// filters have no effect once tables are selected explicitly.
+func (f tableFilter) includesTable(t tableRef) bool {
+	if len(f.tables) > 0 {
+		if !matchAnyQualified(f.tables, t) {
+			return false
+		}
+	} else if !f.includesSchema(t.schema) {
+		return false
+	}
+	return !matchAnyQualified(f.excludeTables, t)
+}
+
+func matchAny(patterns []*regexp.Regexp, value string) bool {
+	for _, p := range patterns {
+		if p.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAnyQualified(patterns []qualifiedPattern, t tableRef) bool {
+	for _, p := range patterns {
+		if p.match(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// compileQualifiedPattern splits a possibly schema-qualified pattern on the
+// first unquoted dot and compiles each half.
+func compileQualifiedPattern(pattern string) qualifiedPattern {
+	inQuotes := false
+	for i, r := range pattern {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+		case r == '.' && !inQuotes:
+			return qualifiedPattern{
+				schema: compilePattern(pattern[:i]),
+				name:   compilePattern(pattern[i+1:]),
+			}
+		}
+	}
+	return qualifiedPattern{name: compilePattern(pattern)}
+}
+
+// compilePattern converts a psql-style name pattern into an anchored regular
+// expression. Outside of double quotes, names are folded to lower case, * matches
+// any sequence of characters and ? matches a single character.
+func compilePattern(pattern string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("^")
+
+	inQuotes := false
+	runes := []rune(pattern)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == '"':
+			// A doubled quote within quotes is a literal quote.
+			if inQuotes && i+1 < len(runes) && runes[i+1] == '"' {
+				b.WriteString(regexp.QuoteMeta(`"`))
+				i++
+				continue
+			}
+			inQuotes = !inQuotes
+		case inQuotes:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		case r == '*':
+			b.WriteString(".*")
+		case r == '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(strings.ToLower(string(r))))
+		}
+	}
+
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
@@ -0,0 +1,611 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cliFlags holds the command line flags, along with the values validateFlags
+// parses from them.
+type cliFlags struct {
+	owner                   bool
+	noOwner                 bool
+	noACL                   bool
+	ownerMap                stringSlice
+	noComments              bool
+	noTablespaces           bool
+	tablespaceMap           stringSlice
+	clean                   bool
+	ifExists                bool
+	create                  bool
+	dataOnly                bool
+	blobs                   bool
+	noBlobs                 bool
+	schemaOnly              bool
+	disableTriggers         bool
+	deferConstraints        bool
+	skipSuperuserObjects    bool
+	fastRestore             bool
+	resetSeqs               bool
+	analyze                 bool
+	reindex                 bool
+	vacuum                  bool
+	refreshMatviews         bool
+	grantTo                 string
+	sections                stringSlice
+	yes                     bool
+	format                  string
+	engine                  string
+	parallel                int
+	jobs                    int
+	snapshot                string
+	serializableDeferrable  bool
+	maxRate                 string
+	compress                string
+	schemas                 stringSlice
+	excludeSchemas          stringSlice
+	tables                  stringSlice
+	excludeTables           stringSlice
+	skipVerify              bool
+	verifySchema            bool
+	verifyChecksum          bool
+	checksumSample          int
+	dryRun                  bool
+	roles                   bool
+	excludeRoles            stringSlice
+	allDatabases            bool
+	includePostgres         bool
+	excludeDatabases        stringSlice
+	ignoreMissingExtensions bool
+	skipSpaceCheck          bool
+	probeFreeSpace          bool
+	minFreeBytes            int64
+	allowSame               bool
+	allowSwapped            bool
+	force                   bool
+	strict                  bool
+	allowPrimary            bool
+	connectRetries          int
+	connectRetryDelay       time.Duration
+	waitForTarget           time.Duration
+	sourceService           string
+	targetService           string
+	sshTunnel               string
+	sshKey                  string
+	sslMode                 string
+	sslRootCert             string
+	sslCert                 string
+	sslKey                  string
+	requireSSL              bool
+	connectTimeout          time.Duration
+	precheckTimeout         time.Duration
+	searchPath              string
+	lockWaitTimeout         time.Duration
+	statementTimeout        time.Duration
+	continueOnError         bool
+	singleTransaction       bool
+	timeout                 time.Duration
+	logFormat               string
+	verbose                 bool
+	progress                bool
+	heartbeat               time.Duration
+	logFile                 string
+	tempDir                 string
+	dumpFile                string
+	keepDump                bool
+	list                    bool
+	useList                 string
+	restoreFrom             string
+	dumpTo                  string
+	noRestore               bool
+	pgVersion               string
+	configPath              string
+	pgDumpPath              string
+	psqlPath                string
+
+	// Set by validateFlags.
+	dumpLocation    *s3Location
+	rate            int64
+	searchPathValue string
+	compression     string
+	tablespaces     map[string]string
+	owners          map[string]string
+	ssl             sslOpts
+}
+
+// registerFlags defines the importer's flags on fs.
+func registerFlags(fs *flag.FlagSet) *cliFlags {
+	f := &cliFlags{}
+
+	// Ownership is preserved by default to match pg_dump, so grants and RLS
+	// policies survive the import. --owner and --no-owner are inverses of each
+	// other and may not be combined.
+	fs.BoolVar(&f.owner, "owner", false, "Preserve object ownership from the source (default)")
+	fs.BoolVar(&f.noOwner, "no-owner", false, "Skip restoring object ownership")
+	fs.BoolVar(&f.noACL, "no-acl", false, "Skip restoring access privileges (GRANT/REVOKE statements)")
+	fs.BoolVar(&f.noACL, "no-privileges", false, "Alias for --no-acl")
+	fs.Var(&f.ownerMap, "owner-map", "Restore objects owned by role OLD as owned by NEW, in the form OLD=NEW (repeatable). Can't be combined with --no-owner")
+	fs.BoolVar(&f.noComments, "no-comments", false, "Skip restoring COMMENT statements")
+	fs.BoolVar(&f.noTablespaces, "no-tablespaces", false, "Skip tablespace assignments so objects are created in the target's default tablespace")
+	// pg_restore has no native tablespace mapping, so mapped archives are
+	// converted to SQL and rewritten on their way into psql.
+	fs.Var(&f.tablespaceMap, "tablespace-map", "Restore objects from tablespace OLD into NEW, in the form OLD=NEW (repeatable). Requires a custom or directory --format; plain dumps only support --no-tablespaces")
+	// Destructive options are opt-in. Existing scripts that relied on clean and
+	// create being enabled by default can set PGIMPORT_LEGACY_DEFAULTS=true.
+	legacyDefaults, _ := strconv.ParseBool(os.Getenv("PGIMPORT_LEGACY_DEFAULTS"))
+	fs.BoolVar(&f.clean, "clean", legacyDefaults, "Drop database objects on the target before recreating them. Requires --force when the target already contains tables being imported")
+	fs.BoolVar(&f.ifExists, "if-exists", true, "With --clean, drop objects with DROP ... IF EXISTS so objects missing from the target aren't errors")
+	fs.BoolVar(&f.create, "create", legacyDefaults, "Create the target database before restoring into it")
+	fs.BoolVar(&f.dataOnly, "data-only", false, "")
+	fs.BoolVar(&f.blobs, "blobs", false, "Include large objects, even with --schema, --table or --schema-only, which leave them out by default")
+	fs.BoolVar(&f.noBlobs, "no-blobs", false, "Leave out large objects")
+	fs.BoolVar(&f.schemaOnly, "schema-only", false, "Only migrate object definitions, not data. Mutually exclusive with --data-only")
+	// Disabling triggers requires superuser privileges on the target, as it
+	// also disables the triggers enforcing foreign keys.
+	fs.BoolVar(&f.disableTriggers, "disable-triggers", false, "Disable triggers, including foreign key checks, while loading a --data-only import. Requires a superuser on the target")
+	fs.BoolVar(&f.deferConstraints, "defer-constraints", false, "Load a --data-only import in a single transaction with deferrable constraints deferred until it commits, so circular foreign keys can be loaded. Implies --single-transaction")
+	fs.BoolVar(&f.skipSuperuserObjects, "skip-superuser-objects", false, "Leave event triggers, functions in untrusted languages and extensions only a superuser can create out of the restore, when the target user isn't a superuser. Requires an archive format")
+	fs.BoolVar(&f.fastRestore, "fast-restore", false, "Restore with maintenance_work_mem raised and synchronous_commit off, and max_wal_size raised server-wide until the restore completes (requires a superuser)")
+	fs.BoolVar(&f.resetSeqs, "reset-sequences", true, "After a --data-only import, advance sequences owned by imported tables past their largest value")
+	fs.BoolVar(&f.analyze, "analyze", true, "Run ANALYZE on the target after the import so the planner has statistics")
+	fs.BoolVar(&f.reindex, "reindex", false, "REINDEX every table on the target after the import, as when its collation versions differ from the source's (uses reindexdb with --jobs)")
+	fs.BoolVar(&f.vacuum, "vacuum", false, "VACUUM (FREEZE) the target after the import, analyzing it in the same pass unless --analyze=false (uses vacuumdb with --jobs)")
+	fs.BoolVar(&f.refreshMatviews, "refresh-matviews", false, "After the import, refresh each materialized view on the target, including those that depend on other views, in dependency order")
+	fs.StringVar(&f.grantTo, "grant-to", "", "After the import, grant this role full access to the tables and sequences in each migrated schema, including ones created later")
+	fs.Var(&f.sections, "section", "Only migrate the named section: pre-data, data or post-data (repeatable). Can't be combined with --schema-only or --data-only")
+	fs.BoolVar(&f.yes, "yes", false, "Skip the confirmation prompt for destructive options")
+	fs.StringVar(&f.format, "format", formatPlain, "Dump format: plain, custom or directory. Non-plain formats are restored with pg_restore")
+	// The pgx engine is experimental, and only copies tables.
+	fs.StringVar(&f.engine, "engine", enginePgDump, "Import engine: pg_dump, or pgx to copy tables in-process with COPY, without needing the client tools (experimental)")
+	fs.IntVar(&f.parallel, "parallel", 0, "Dump in directory format and both dump and restore with this many jobs. The dump is written to a temporary directory, removed afterwards")
+	fs.IntVar(&f.jobs, "jobs", 1, "Number of parallel pg_restore jobs, also used by pg_dump with --format=directory. Values above 1 require a custom or directory --format, or copy that many tables at once with --engine=pgx")
+	// pg_dump always reads from a single snapshot, holding ACCESS SHARE locks
+	// on each dumped table until it finishes, which blocks DDL but not writes.
+	// Parallel directory dumps synchronize their workers on one snapshot.
+	fs.StringVar(&f.snapshot, "snapshot", "", "Dump from this exported snapshot (see pg_export_snapshot()) so the dump matches a point in time chosen elsewhere")
+	fs.BoolVar(&f.serializableDeferrable, "serializable-deferrable", false, "Dump in a serializable, deferrable transaction so the data is consistent with every serial order of concurrent writes. May wait for a safe snapshot before starting")
+	fs.StringVar(&f.maxRate, "max-rate", "", "Limit how fast the dump is read from the source, in bytes per second with an optional K, M or G suffix (e.g. 20M). Not supported with --format=directory")
+	fs.StringVar(&f.compress, "compress", "", "Compression for custom and directory format dumps: a gzip level from 0 to 9, or zstd[:LEVEL] with pg_dump 16 or later (defaults to pg_dump's default)")
+	fs.Var(&f.schemas, "schema", "Only migrate schemas matching this pattern (repeatable)")
+	fs.Var(&f.excludeSchemas, "exclude-schema", "Skip schemas matching this pattern (repeatable)")
+	// When combined with --clean, only the selected tables are dropped and
+	// recreated on the target.
+	fs.Var(&f.tables, "table", "Only migrate tables matching this pattern, optionally schema-qualified (repeatable). With --clean, only the selected tables are cleaned")
+	fs.Var(&f.excludeTables, "exclude-table", "Skip tables matching this pattern, optionally schema-qualified (repeatable)")
+	fs.BoolVar(&f.skipVerify, "skip-verify", false, "Skip comparing row counts between source and target after the import")
+	fs.BoolVar(&f.verifySchema, "verify-schema", false, "After the import, compare the number of tables, views, materialized views, functions, sequences and indexes between source and target")
+	fs.BoolVar(&f.verifyChecksum, "verify-checksum", false, "After the import, compare a checksum of every row in each table between source and target. This reads every table in full on both")
+	fs.IntVar(&f.checksumSample, "checksum-sample", 100, "With --verify-checksum, only hash this percentage of each table's rows. The same rows are sampled on both sides")
+	fs.BoolVar(&f.dryRun, "dry-run", false, "Run pre-checks and print the commands that would be run without importing anything")
+	fs.BoolVar(&f.roles, "roles", false, "Copy role definitions from the source cluster with pg_dumpall before importing")
+	fs.Var(&f.excludeRoles, "exclude-role", "Skip this role when copying roles with --roles, in addition to the administrative roles of managed services such as rds_superuser and cloudsqlsuperuser (repeatable)")
+	// Each database is imported into one of the same name on the target,
+	// which is created with the source's encoding and locale if missing.
+	fs.BoolVar(&f.allDatabases, "all-databases", false, "Import every database in the source cluster rather than the one in SOURCE_DATABASE_URI. Implies --create for databases missing from the target")
+	fs.BoolVar(&f.includePostgres, "include-postgres", false, "With --all-databases, also import the postgres maintenance database")
+	fs.Var(&f.excludeDatabases, "exclude-database", "With --all-databases, skip databases matching this pattern (repeatable)")
+	fs.BoolVar(&f.ignoreMissingExtensions, "ignore-missing-extensions", false, "Continue when extensions used by the source aren't available on the target")
+	fs.BoolVar(&f.skipSpaceCheck, "skip-space-check", false, "Skip checking the target has enough free disk space for the import")
+	fs.BoolVar(&f.probeFreeSpace, "probe-free-space", false, "Measure the target's free disk space by running df on the database server with COPY FROM PROGRAM, which requires a superuser or pg_execute_server_program")
+	fs.Int64Var(&f.minFreeBytes, "min-free-bytes", 0, "Free disk space required on the target, in bytes (defaults to the size of the source database). Implies --probe-free-space")
+	fs.BoolVar(&f.allowSame, "allow-same", false, "Allow the source and target to refer to the same database")
+	fs.BoolVar(&f.allowSwapped, "allow-swapped", false, "Import even though the source looks like a Fly Postgres app and the target like an external database, as if the two were swapped")
+	// --force predates the non-empty target check as an alias for --yes, and
+	// still skips the confirmation prompt too.
+	fs.BoolVar(&f.force, "force", false, "Import even if the target already contains tables being imported. Implies --yes")
+	fs.BoolVar(&f.strict, "strict", false, "Fail pre-checks when the source and target databases differ in encoding or locale, rather than warning")
+	fs.BoolVar(&f.allowPrimary, "allow-primary", false, "Acknowledge importing from a primary, skipping the warning about dumping under write load")
+	fs.IntVar(&f.connectRetries, "connect-retries", 3, "Number of times to retry a failed connection to the source or target")
+	fs.DurationVar(&f.connectRetryDelay, "connect-retry-delay", time.Second, "Delay before the first connection retry, doubling after each attempt")
+	fs.DurationVar(&f.waitForTarget, "wait-for-target", 0, "Wait up to this long for the target to accept connections before running pre-checks (e.g. 2m)")
+	// Services are resolved from PGSERVICEFILE, or ~/.pg_service.conf.
+	fs.StringVar(&f.sourceService, "source-service", "", "Connect to the source through this pg_service.conf entry instead of SOURCE_DATABASE_URI")
+	fs.StringVar(&f.targetService, "target-service", "", "Connect to the target through this pg_service.conf entry instead of TARGET_DATABASE_URI")
+	fs.StringVar(&f.sshTunnel, "ssh-tunnel", "", "Reach the source through an SSH forward via this bastion, given as user@host[:port]")
+	fs.StringVar(&f.sshKey, "ssh-key", "", "Private key used to authenticate to the --ssh-tunnel bastion (defaults to ssh's own)")
+	fs.StringVar(&f.sslMode, "sslmode", "", "Override the sslmode of the source and target connections: disable, allow, prefer, require, verify-ca or verify-full (defaults to the connection string's)")
+	fs.StringVar(&f.sslRootCert, "sslrootcert", "", "CA bundle used to verify the source and target certificates with --sslmode=verify-ca or verify-full")
+	fs.StringVar(&f.sslCert, "sslcert", "", "Client certificate presented to the source and target")
+	fs.StringVar(&f.sslKey, "sslkey", "", "Private key of the --sslcert client certificate")
+	fs.BoolVar(&f.requireSSL, "require-ssl", false, "Fail pre-checks unless the source and target connections are encrypted. Implies --sslmode=require unless a stricter mode is given")
+	fs.DurationVar(&f.connectTimeout, "connect-timeout", 5*time.Second, "Timeout for establishing each connection to the source or target")
+	fs.DurationVar(&f.precheckTimeout, "precheck-timeout", 0, "Overall time limit for pre-checks, excluding --wait-for-target (defaults to no limit)")
+	fs.StringVar(&f.searchPath, "search-path", "", "Set search_path for the restore session to this comma-separated list of schemas. Dumps written by pg_dump set their own")
+	fs.DurationVar(&f.lockWaitTimeout, "lock-wait-timeout", 0, "Fail the dump if a table's lock can't be acquired within this long, rather than waiting behind long transactions or DDL on the source (defaults to no limit)")
+	fs.DurationVar(&f.statementTimeout, "statement-timeout", 0, "Abort any statement in the restore session that runs longer than this (defaults to no limit)")
+	fs.BoolVar(&f.continueOnError, "continue-on-error", false, "Keep restoring after a statement fails instead of stopping at the first error")
+	// --single-transaction can't be combined with --jobs > 1, as parallel
+	// restores use a connection per job, or with --create, as CREATE DATABASE
+	// can't run inside a transaction.
+	fs.BoolVar(&f.singleTransaction, "single-transaction", false, "Restore as a single transaction so a failure leaves the target untouched. Incompatible with --jobs > 1 and --create")
+	fs.DurationVar(&f.timeout, "timeout", 0, "Abort the import if it hasn't completed within this duration (defaults to no limit)")
+	fs.StringVar(&f.logFormat, "log-format", logFormatText, "Log output format: text or json")
+	fs.BoolVar(&f.verbose, "verbose", false, "Log per-object progress from pg_dump and pg_restore as it happens")
+	fs.BoolVar(&f.progress, "progress", false, "Log which table is loading, and how far through it the restore is, from pg_stat_progress_copy on the target (Postgres 14+)")
+	fs.DurationVar(&f.heartbeat, "heartbeat", 5*time.Minute, "Log the elapsed time and current phase this often while the import runs, or 0 to disable")
+	fs.StringVar(&f.logFile, "log-file", "", "Append the complete output of pg_dump, pg_restore and psql to this file")
+	fs.StringVar(&f.tempDir, "temp-dir", "", "Directory used to stage custom and directory format dumps (defaults to the system temp directory)")
+	// A dump file makes the import resumable: when it already exists from an
+	// earlier run, the dump is skipped and the file is restored instead.
+	fs.StringVar(&f.dumpFile, "dump-file", "", "Dump to this path before restoring, or restore from it if it already exists. Implies --format=custom unless --format=directory")
+	fs.BoolVar(&f.keepDump, "keep-dump", false, "Keep the --dump-file after a successful restore")
+	fs.BoolVar(&f.list, "list", false, "Print the table of contents of the --restore-from archive, as pg_restore --list does, and exit without importing anything")
+	fs.StringVar(&f.useList, "use-list", "", "Only restore the --restore-from archive entries in this table of contents, as printed by --list and possibly edited. Entries are restored in the order listed")
+	fs.StringVar(&f.restoreFrom, "restore-from", "", "Restore an existing plain or archive dump from this path or http(s) URL instead of dumping a source database")
+	// Uploads authenticate with the standard AWS_* environment variables, and
+	// S3 compatible services are reached through AWS_ENDPOINT_URL_S3.
+	fs.StringVar(&f.dumpTo, "dump-to", "", "Also upload the dump to s3://bucket/key. Not supported with --format=directory")
+	fs.BoolVar(&f.noRestore, "no-restore", false, "With --dump-to, only upload the dump without restoring it")
+	// Images may ship client tools for several major versions. Unless a path
+	// is given, the tools matching the source version are used when present.
+	fs.StringVar(&f.pgVersion, "pg-version", "", "Use the client tools for this Postgres major version, e.g. 14 (defaults to the source version)")
+	fs.StringVar(&f.configPath, "config", "", "Read options from this TOML file, with flag names as keys. Flags on the command line take precedence")
+	fs.StringVar(&f.pgDumpPath, "pg-dump-path", "", "Path to the pg_dump binary (defaults to the one matching --pg-version, else PATH)")
+	fs.StringVar(&f.psqlPath, "psql-path", "", "Path to the psql binary (defaults to the one matching --pg-version, else PATH)")
+
+	return f
+}
+
+// validateFlags checks the flags form a usable combination once parsed,
+// applies the options some flags imply, and parses those with structured
+// values. Its errors are usage errors.
+func validateFlags(f *cliFlags) error {
+	var err error
+
+	if f.owner && f.noOwner {
+		return errors.New("--owner and --no-owner are mutually exclusive")
+	}
+
+	if f.schemaOnly && f.dataOnly {
+		return errors.New("--schema-only and --data-only are mutually exclusive")
+	}
+
+	if f.blobs && f.noBlobs {
+		return errors.New("--blobs and --no-blobs are mutually exclusive")
+	}
+
+	// --parallel is shorthand for a directory dump, written and restored
+	// with the same number of jobs.
+	if f.parallel != 0 {
+		var conflict string
+		switch {
+		case f.parallel < 1:
+			return fmt.Errorf("--parallel must be at least 1, got %d", f.parallel)
+		case f.format != formatPlain && f.format != formatDirectory:
+			conflict = "--format=" + f.format
+		case f.jobs != 1 && f.jobs != f.parallel:
+			conflict = "--jobs"
+		case f.engine != enginePgDump:
+			conflict = "--engine=" + f.engine
+		case f.restoreFrom != "":
+			conflict = "--restore-from"
+		case f.dumpTo != "":
+			conflict = "--dump-to"
+		}
+		if conflict != "" {
+			return fmt.Errorf("--parallel implies --format=directory and --jobs, so it can't be combined with %s", conflict)
+		}
+		f.format = formatDirectory
+		f.jobs = f.parallel
+	}
+
+	// Data only restores load rows into tables that already exist, so they
+	// can't also drop or create the database and objects around them.
+	if f.dataOnly && f.create {
+		return errors.New("--data-only and --create are mutually exclusive")
+	}
+
+	if f.dataOnly && f.clean {
+		return errors.New("--data-only and --clean are mutually exclusive, as --clean drops the tables the data is loaded into")
+	}
+
+	for _, section := range f.sections {
+		switch section {
+		case "pre-data", "data", "post-data":
+		default:
+			return fmt.Errorf("unsupported --section %q. expected pre-data, data or post-data", section)
+		}
+	}
+
+	if f.disableTriggers && !f.dataOnly {
+		return errors.New("--disable-triggers requires --data-only")
+	}
+
+	if f.deferConstraints {
+		if !f.dataOnly {
+			return errors.New("--defer-constraints requires --data-only")
+		}
+		if f.jobs > 1 {
+			return errors.New("--defer-constraints can't be combined with --jobs greater than 1, as the data is loaded in a single transaction")
+		}
+		f.singleTransaction = true
+	}
+
+	// A threshold can only be checked against the probed free space.
+	if f.minFreeBytes > 0 {
+		f.probeFreeSpace = true
+	}
+
+	if len(f.sections) > 0 && (f.schemaOnly || f.dataOnly) {
+		return errors.New("--section can't be combined with --schema-only or --data-only")
+	}
+
+	switch f.format {
+	case formatPlain, formatCustom, formatDirectory:
+	default:
+		return fmt.Errorf("unsupported --format %q. expected plain, custom or directory", f.format)
+	}
+
+	switch f.engine {
+	case enginePgDump:
+	case enginePgx:
+		// The pgx engine copies tables directly, so options that shape a dump
+		// or restore through the client tools don't apply.
+		for _, option := range []struct {
+			name string
+			set  bool
+		}{
+			{"--restore-from", f.restoreFrom != ""},
+			{"--dump-file", f.dumpFile != ""},
+			{"--dump-to", f.dumpTo != ""},
+			{"--format", f.format != formatPlain},
+			{"--compress", f.compress != ""},
+			{"--create", f.create},
+			{"--clean", f.clean},
+			{"--section", len(f.sections) > 0},
+			{"--defer-constraints", f.deferConstraints},
+			{"--blobs", f.blobs},
+			{"--skip-superuser-objects", f.skipSuperuserObjects},
+			{"--search-path", f.searchPath != ""},
+			{"--single-transaction", f.singleTransaction},
+			{"--roles", f.roles},
+			{"--tablespace-map", len(f.tablespaceMap) > 0},
+			{"--owner-map", len(f.ownerMap) > 0},
+		} {
+			if option.set {
+				return fmt.Errorf("%s isn't supported with --engine=pgx", option.name)
+			}
+		}
+		// Tables aren't loaded in foreign key order, so a data-only load
+		// into tables whose foreign keys exist would fail on child rows.
+		if f.dataOnly && !f.disableTriggers {
+			return errors.New("--engine=pgx with --data-only requires --disable-triggers, as tables aren't loaded in foreign key order")
+		}
+	default:
+		return fmt.Errorf("unsupported --engine %q. expected pg_dump or pgx", f.engine)
+	}
+
+	if f.keepDump && f.dumpFile == "" {
+		return errors.New("--keep-dump requires --dump-file")
+	}
+
+	if f.dumpFile != "" && f.format == formatPlain {
+		f.format = formatCustom
+	}
+
+	// Without a source there's nothing to dump, so options that only shape
+	// the dump can't be honoured.
+	if f.restoreFrom != "" {
+		for _, option := range []struct {
+			name string
+			set  bool
+		}{
+			{"--dump-file", f.dumpFile != ""},
+			{"--roles", f.roles},
+			{"--create", f.create},
+			{"--data-only", f.dataOnly},
+			{"--schema-only", f.schemaOnly},
+			{"--section", len(f.sections) > 0},
+			{"--schema", len(f.schemas) > 0},
+			{"--exclude-schema", len(f.excludeSchemas) > 0},
+			{"--table", len(f.tables) > 0},
+			{"--exclude-table", len(f.excludeTables) > 0},
+			{"--compress", f.compress != ""},
+			{"--dump-to", f.dumpTo != ""},
+		} {
+			if option.set {
+				return fmt.Errorf("%s can't be combined with --restore-from", option.name)
+			}
+		}
+	}
+
+	if f.list && f.restoreFrom == "" {
+		return errors.New("--list requires --restore-from")
+	}
+
+	if f.useList != "" {
+		if f.restoreFrom == "" {
+			return errors.New("--use-list requires --restore-from")
+		}
+		if _, err := os.Stat(f.useList); err != nil {
+			return fmt.Errorf("--use-list: %w", err)
+		}
+	}
+
+	if f.dumpTo != "" {
+		loc, err := parseS3Location(f.dumpTo)
+		if err != nil {
+			return err
+		}
+		if f.format == formatDirectory {
+			return errors.New("--dump-to can't upload --format=directory dumps, use plain or custom")
+		}
+		f.dumpLocation = &loc
+	}
+
+	if f.noRestore && f.dumpTo == "" {
+		return errors.New("--no-restore requires --dump-to")
+	}
+
+	if f.noRestore && f.roles {
+		return errors.New("--roles can't be combined with --no-restore, as roles are copied straight into the target")
+	}
+
+	if f.includePostgres && !f.allDatabases {
+		return errors.New("--include-postgres requires --all-databases")
+	}
+
+	if len(f.excludeDatabases) > 0 && !f.allDatabases {
+		return errors.New("--exclude-database requires --all-databases")
+	}
+
+	// Options naming a single dump, or a single database to confirm, can't
+	// apply to each database of the cluster.
+	if f.allDatabases {
+		for _, option := range []struct {
+			name string
+			set  bool
+		}{
+			{"--restore-from", f.restoreFrom != ""},
+			{"--dump-file", f.dumpFile != ""},
+			{"--dump-to", f.dumpTo != ""},
+			{"--defer-constraints", f.deferConstraints},
+			{"--single-transaction", f.singleTransaction},
+			{"--clean without --yes", f.clean && !f.yes && !f.force},
+		} {
+			if option.set {
+				return fmt.Errorf("--all-databases can't be combined with %s", option.name)
+			}
+		}
+	}
+
+	f.rate, err = parseByteSize(f.maxRate)
+	if err != nil {
+		return fmt.Errorf("invalid --max-rate: %w", err)
+	}
+
+	if f.rate > 0 && f.format == formatDirectory {
+		return errors.New("--max-rate can't throttle --format=directory dumps, as pg_dump writes each table to its own file")
+	}
+
+	if f.snapshot != "" && f.serializableDeferrable {
+		return errors.New("--snapshot and --serializable-deferrable are mutually exclusive, as the exported snapshot determines the transaction's view")
+	}
+
+	f.searchPathValue, err = parseSearchPath(f.searchPath)
+	if err != nil {
+		return err
+	}
+
+	f.compression, err = parseCompression(f.compress)
+	if err != nil {
+		return err
+	}
+
+	if f.compression != "" && f.format == formatPlain {
+		return errors.New("--compress requires --format=custom or --format=directory, as plain dumps are streamed uncompressed into psql")
+	}
+
+	if f.checksumSample < 1 || f.checksumSample > 100 {
+		return fmt.Errorf("--checksum-sample must be between 1 and 100, got %d", f.checksumSample)
+	}
+	if f.verifyChecksum && (f.restoreFrom != "" || f.schemaOnly) {
+		return errors.New("--verify-checksum requires a source to compare against and data to compare, so it can't be combined with --restore-from or --schema-only")
+	}
+
+	if f.jobs < 1 {
+		return fmt.Errorf("--jobs must be at least 1, got %d", f.jobs)
+	}
+
+	if f.skipSuperuserObjects && f.format == formatPlain && f.restoreFrom == "" && f.engine != enginePgx {
+		return errors.New("--skip-superuser-objects requires --format=custom or --format=directory, as entries are filtered from the archive's table of contents")
+	}
+
+	if f.jobs > 1 && f.format == formatPlain && f.restoreFrom == "" && f.engine != enginePgx {
+		return errors.New("--jobs greater than 1 requires --format=custom or --format=directory, as plain dumps are restored serially by psql")
+	}
+
+	if f.singleTransaction && f.jobs > 1 {
+		return errors.New("--single-transaction can't be combined with --jobs greater than 1")
+	}
+
+	if f.singleTransaction && f.create {
+		return errors.New("--single-transaction can't be combined with --create, as CREATE DATABASE can't run inside a transaction")
+	}
+
+	// Postgres takes the timeout in whole milliseconds, where 0 means no
+	// limit at all.
+	if f.lockWaitTimeout < 0 || (f.lockWaitTimeout > 0 && f.lockWaitTimeout < time.Millisecond) {
+		return fmt.Errorf("--lock-wait-timeout must be at least 1ms, got %s", f.lockWaitTimeout)
+	}
+
+	if f.heartbeat < 0 {
+		return fmt.Errorf("--heartbeat can't be negative, got %s", f.heartbeat)
+	}
+
+	if f.connectRetries < 0 {
+		return fmt.Errorf("--connect-retries can't be negative, got %d", f.connectRetries)
+	}
+
+	if f.connectTimeout <= 0 {
+		return fmt.Errorf("--connect-timeout must be positive, got %s", f.connectTimeout)
+	}
+
+	f.tablespaces, err = parseMappings("tablespace-map", f.tablespaceMap)
+	if err != nil {
+		return err
+	}
+
+	if len(f.tablespaces) > 0 {
+		var conflict string
+		switch {
+		case f.format == formatPlain && f.restoreFrom == "":
+			conflict = "--format=plain, use --no-tablespaces instead"
+		case f.noTablespaces:
+			conflict = "--no-tablespaces"
+		case f.jobs > 1:
+			conflict = "--jobs greater than 1"
+		}
+		if conflict != "" {
+			return fmt.Errorf("--tablespace-map can't be combined with %s", conflict)
+		}
+	}
+
+	f.owners, err = parseMappings("owner-map", f.ownerMap)
+	if err != nil {
+		return err
+	}
+
+	if len(f.owners) > 0 {
+		var conflict string
+		switch {
+		case f.noOwner:
+			conflict = "--no-owner"
+		case f.jobs > 1:
+			conflict = "--jobs greater than 1"
+		}
+		if conflict != "" {
+			return fmt.Errorf("--owner-map can't be combined with %s", conflict)
+		}
+	}
+
+	for _, schema := range f.schemas {
+		for _, excluded := range f.excludeSchemas {
+			if schema == excluded {
+				return fmt.Errorf("schema %q can't be both included with --schema and excluded with --exclude-schema", schema)
+			}
+		}
+	}
+
+	// TLS settings override those in both connection strings, and so apply to
+	// the pre-check connections and client tools alike.
+	f.ssl = sslOpts{mode: f.sslMode, rootCert: f.sslRootCert, cert: f.sslCert, key: f.sslKey}
+	if f.ssl.mode != "" && !contains(sslModes, f.ssl.mode) {
+		return fmt.Errorf("unsupported --sslmode %q. expected one of %s", f.ssl.mode, strings.Join(sslModes, ", "))
+	}
+	if f.requireSSL {
+		switch f.ssl.mode {
+		case "":
+			f.ssl.mode = "require"
+		case "disable", "allow", "prefer":
+			return fmt.Errorf("--require-ssl can't be combined with --sslmode=%s", f.ssl.mode)
+		}
+	}
+
+	return nil
+}
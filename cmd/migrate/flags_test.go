@@ -0,0 +1,137 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"strings"
+	"testing"
+)
+
+func parseTestFlags(t *testing.T, args ...string) *cliFlags {
+	t.Helper()
+	// The legacy defaults enable --clean and --create.
+	t.Setenv("PGIMPORT_LEGACY_DEFAULTS", "")
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	f := registerFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatalf("failed to parse %q: %s", args, err)
+	}
+	return f
+}
+
+func TestValidateFlagsRejectsInvalidCombinations(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--owner", "--no-owner"}, "--owner and --no-owner are mutually exclusive"},
+		{[]string{"--schema-only", "--data-only"}, "--schema-only and --data-only are mutually exclusive"},
+		{[]string{"--blobs", "--no-blobs"}, "--blobs and --no-blobs are mutually exclusive"},
+		{[]string{"--parallel=-1"}, "--parallel must be at least 1"},
+		{[]string{"--parallel=4", "--format=custom"}, "can't be combined with --format=custom"},
+		{[]string{"--parallel=4", "--jobs=2"}, "can't be combined with --jobs"},
+		{[]string{"--data-only", "--create"}, "--data-only and --create are mutually exclusive"},
+		{[]string{"--data-only", "--clean"}, "--data-only and --clean are mutually exclusive"},
+		{[]string{"--section=everything"}, `unsupported --section "everything"`},
+		{[]string{"--disable-triggers"}, "--disable-triggers requires --data-only"},
+		{[]string{"--defer-constraints"}, "--defer-constraints requires --data-only"},
+		{[]string{"--data-only", "--defer-constraints", "--format=custom", "--jobs=2"}, "--defer-constraints can't be combined with --jobs"},
+		{[]string{"--section=data", "--schema-only"}, "--section can't be combined with --schema-only or --data-only"},
+		{[]string{"--format=tar"}, `unsupported --format "tar"`},
+		{[]string{"--engine=pgx", "--roles"}, "--roles isn't supported with --engine=pgx"},
+		{[]string{"--engine=pgx", "--format=custom"}, "--format isn't supported with --engine=pgx"},
+		{[]string{"--engine=pgx", "--data-only"}, "--engine=pgx with --data-only requires --disable-triggers, as tables aren't loaded in foreign key order"},
+		{[]string{"--engine=rsync"}, `unsupported --engine "rsync"`},
+		{[]string{"--keep-dump"}, "--keep-dump requires --dump-file"},
+		{[]string{"--restore-from=dump.pgdump", "--schema=public"}, "--schema can't be combined with --restore-from"},
+		{[]string{"--list"}, "--list requires --restore-from"},
+		{[]string{"--use-list=dump.list"}, "--use-list requires --restore-from"},
+		{[]string{"--dump-to=s3://bucket/key", "--format=directory"}, "--dump-to can't upload --format=directory dumps"},
+		{[]string{"--no-restore"}, "--no-restore requires --dump-to"},
+		{[]string{"--include-postgres"}, "--include-postgres requires --all-databases"},
+		{[]string{"--exclude-database=staging"}, "--exclude-database requires --all-databases"},
+		{[]string{"--all-databases", "--single-transaction"}, "--all-databases can't be combined with --single-transaction"},
+		{[]string{"--all-databases", "--clean"}, "--all-databases can't be combined with --clean without --yes"},
+		{[]string{"--max-rate=fast"}, "invalid --max-rate"},
+		{[]string{"--max-rate=20M", "--format=directory"}, "--max-rate can't throttle --format=directory dumps"},
+		{[]string{"--snapshot=00000003-1", "--serializable-deferrable"}, "--snapshot and --serializable-deferrable are mutually exclusive"},
+		{[]string{"--search-path=public;drop"}, "invalid --search-path"},
+		{[]string{"--compress=9"}, "--compress requires --format=custom or --format=directory"},
+		{[]string{"--checksum-sample=0"}, "--checksum-sample must be between 1 and 100"},
+		{[]string{"--verify-checksum", "--schema-only"}, "--verify-checksum requires a source to compare against"},
+		{[]string{"--jobs=0"}, "--jobs must be at least 1"},
+		{[]string{"--skip-superuser-objects"}, "--skip-superuser-objects requires --format=custom or --format=directory"},
+		{[]string{"--jobs=4"}, "--jobs greater than 1 requires --format=custom or --format=directory"},
+		{[]string{"--single-transaction", "--format=custom", "--jobs=2"}, "--single-transaction can't be combined with --jobs"},
+		{[]string{"--single-transaction", "--create"}, "--single-transaction can't be combined with --create"},
+		{[]string{"--lock-wait-timeout=500us"}, "--lock-wait-timeout must be at least 1ms"},
+		{[]string{"--heartbeat=-1s"}, "--heartbeat can't be negative"},
+		{[]string{"--connect-retries=-1"}, "--connect-retries can't be negative"},
+		{[]string{"--connect-timeout=0"}, "--connect-timeout must be positive"},
+		{[]string{"--tablespace-map=fast=slow"}, "--tablespace-map can't be combined with --format=plain"},
+		{[]string{"--format=custom", "--tablespace-map=fast=slow", "--no-tablespaces"}, "--tablespace-map can't be combined with --no-tablespaces"},
+		{[]string{"--owner-map=old=new", "--no-owner"}, "--owner-map can't be combined with --no-owner"},
+		{[]string{"--schema=public", "--exclude-schema=public"}, `schema "public" can't be both included with --schema and excluded`},
+		{[]string{"--sslmode=sometimes"}, `unsupported --sslmode "sometimes"`},
+		{[]string{"--require-ssl", "--sslmode=prefer"}, "--require-ssl can't be combined with --sslmode=prefer"},
+	} {
+		t.Run(strings.Join(tc.args, " "), func(t *testing.T) {
+			err := validateFlags(parseTestFlags(t, tc.args...))
+			if err == nil {
+				t.Fatalf("expected an error containing %q, got none", tc.want)
+			}
+			if !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("expected an error containing %q, got %q", tc.want, err)
+			}
+		})
+	}
+}
+
+func TestValidateFlagsAppliesImpliedOptions(t *testing.T) {
+	f := parseTestFlags(t, "--parallel=4")
+	if err := validateFlags(f); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if f.format != formatDirectory || f.jobs != 4 {
+		t.Errorf("expected --parallel=4 to imply --format=directory --jobs=4, got --format=%s --jobs=%d", f.format, f.jobs)
+	}
+
+	f = parseTestFlags(t, "--data-only", "--defer-constraints")
+	if err := validateFlags(f); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !f.singleTransaction {
+		t.Error("expected --defer-constraints to imply --single-transaction")
+	}
+
+	f = parseTestFlags(t, "--dump-file=dump.pgdump")
+	if err := validateFlags(f); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if f.format != formatCustom {
+		t.Errorf("expected --dump-file to imply --format=custom, got %s", f.format)
+	}
+
+	f = parseTestFlags(t, "--min-free-bytes=1000000")
+	if err := validateFlags(f); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !f.probeFreeSpace {
+		t.Error("expected --min-free-bytes to imply --probe-free-space")
+	}
+
+	f = parseTestFlags(t, "--require-ssl")
+	if err := validateFlags(f); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if f.ssl.mode != "require" {
+		t.Errorf("expected --require-ssl to imply --sslmode=require, got %q", f.ssl.mode)
+	}
+}
+
+func TestValidateFlagsAcceptsDefaults(t *testing.T) {
+	if err := validateFlags(parseTestFlags(t)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// commandLog records the complete output of every child process when
+// --log-file is set, while the console only shows it as it streams past and
+// the tail of it on failure.
+var commandLog = &commandLogger{}
+
+// commandLogger appends lines to the log file. Writes are unbuffered, so the
+// file is complete up to the last line even if the process exits abruptly.
+type commandLogger struct {
+	mu     sync.Mutex
+	f      *os.File
+	redact func(string) string
+}
+
+// open starts recording to the file at path, masking credentials with redact.
+// An existing file is appended to, so the logs of earlier attempts survive.
+func (l *commandLogger) open(path string, redact func(string) string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open --log-file: %w", err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.f = f
+	l.redact = redact
+	return nil
+}
+
+func (l *commandLogger) enabled() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f != nil
+}
+
+// writeLine records line, prefixed with the time it was written.
+func (l *commandLogger) writeLine(line string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return
+	}
+	_, _ = fmt.Fprintf(l.f, "%s %s\n", time.Now().UTC().Format(time.RFC3339), l.redact(line))
+}
+
+// close flushes the file to disk and stops recording.
+func (l *commandLogger) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return
+	}
+	_ = l.f.Sync()
+	_ = l.f.Close()
+	l.f = nil
+}
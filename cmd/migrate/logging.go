@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Supported --log-format values.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// Phases of an import, reported with each structured log entry.
+const (
+	phaseSetup     = "setup"
+	phasePrechecks = "prechecks"
+	phaseRoles     = "roles"
+	phaseDump      = "dump"
+	phaseRestore   = "restore"
+	phaseVerify    = "verify"
+)
+
+var (
+	phaseMu sync.Mutex
+	phase   = phaseSetup
+)
+
+// setPhase records the phase the import has entered.
+func setPhase(p string) {
+	phaseMu.Lock()
+	defer phaseMu.Unlock()
+	phase = p
+}
+
+func currentPhase() string {
+	phaseMu.Lock()
+	defer phaseMu.Unlock()
+	return phase
+}
+
+// logEntry is a single structured log event.
+type logEntry struct {
+	Level     string `json:"level"`
+	Timestamp string `json:"timestamp"`
+	Phase     string `json:"phase"`
+	Source    string `json:"source,omitempty"`
+	Message   string `json:"message,omitempty"`
+
+	// Event and Data describe a structured event such as the summary.
+	Event string          `json:"event,omitempty"`
+	Data  json.RawMessage `json:"data,omitempty"`
+}
+
+// jsonLogWriter converts the lines written by the standard logger into JSON
+// objects, one per line. The leading "[level]" tag of each message becomes
+// its level, while any other tag, such as "[pg_dump]", identifies the command
+// the output came from. An "[event:<name>]" tag marks a message holding a JSON
+// document, which is embedded as the entry's data.
+type jsonLogWriter struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func newJSONLogWriter(out io.Writer) *jsonLogWriter {
+	return &jsonLogWriter{out: out}
+}
+
+func (w *jsonLogWriter) Write(p []byte) (int, error) {
+	entry := logEntry{
+		Level:     "info",
+		Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+		Phase:     currentPhase(),
+		Message:   strings.TrimSuffix(string(p), "\n"),
+	}
+
+	if strings.HasPrefix(entry.Message, "[") {
+		if i := strings.Index(entry.Message, "] "); i > 0 {
+			tag, rest := entry.Message[1:i], entry.Message[i+2:]
+			entry.Message = rest
+
+			switch {
+			case tag == "debug" || tag == "info" || tag == "warn" || tag == "error":
+				entry.Level = tag
+			case strings.HasPrefix(tag, "event:") && json.Valid([]byte(rest)):
+				entry.Event = strings.TrimPrefix(tag, "event:")
+				entry.Data = json.RawMessage(rest)
+				entry.Message = ""
+			default:
+				entry.Source = tag
+			}
+		}
+	}
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return 0, err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := w.out.Write(append(b, '\n')); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
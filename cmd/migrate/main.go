@@ -2,177 +2,734 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net/url"
 	"os"
-	"os/exec"
+	"regexp"
+	"strconv"
 	"strings"
-	"syscall"
 	"time"
 
 	"github.com/jackc/pgx/v5"
 )
 
+// Supported pg_dump output formats.
+const (
+	formatPlain     = "plain"
+	formatCustom    = "custom"
+	formatDirectory = "directory"
+)
+
+// deps holds the external systems an import interacts with. They're passed
+// explicitly so tests can substitute fakes for commands and connections.
+type deps struct {
+	runner CommandRunner
+	opener ConnOpener
+	// s3 is only configured when the dump is uploaded with --dump-to.
+	s3 *s3Client
+}
+
 type migrationOpts struct {
-	sourceURI string
-	targetURI string
-	noOwner   bool
-	clean     bool
-	create    bool
-	dataOnly  bool
+	sourceURI  string
+	targetURI  string
+	noOwner    bool
+	noACL      bool
+	clean      bool
+	ifExists   bool
+	create     bool
+	dataOnly   bool
+	schemaOnly bool
+	sections   []string
+	yes        bool
+
+	noComments    bool
+	noTablespaces bool
+	// blobs and noBlobs include or leave out large objects, overriding
+	// pg_dump's default.
+	blobs         bool
+	noBlobs       bool
+	tablespaceMap map[string]string
+	ownerMap      map[string]string
+
+	disableTriggers bool
+	// useList is a table of contents listing the archive entries to
+	// restore. skipSuperuserObjects filters the objects in superuserObjects,
+	// found by the pre-checks, out of it.
+	useList              string
+	skipSuperuserObjects bool
+	superuserObjects     []superuserObject
+	// deferConstraints loads a --data-only import in a single transaction
+	// with deferrable constraints deferred until it commits.
+	deferConstraints bool
+	fastRestore      bool
+	vacuum           bool
+	reindex          bool
+	resetSequences   bool
+	analyze          bool
+	refreshMatviews  bool
+	grantTo          string
+	format           string
+	engine           string
+	tempDir          string
+	dumpFile         string
+	keepDump         bool
+	restoreFrom      string
+	dumpTo           *s3Location
+	noRestore        bool
+	pgVersion        string
+	pgDumpPath       string
+	psqlPath         string
+	pgRestorePath    string
+	pgDumpallPath    string
+	vacuumdbPath     string
+	reindexdbPath    string
+	jobs             int
+	parallel         bool
+	compress         string
+
+	snapshot               string
+	serializableDeferrable bool
+	lockWaitTimeout        time.Duration
+	maxRate                int64
+
+	schemas        []string
+	excludeSchemas []string
+	tables         []string
+	excludeTables  []string
+
+	skipVerify   bool
+	verifySchema bool
+	// verifyChecksum compares a checksum of each table's rows, hashing
+	// checksumSample percent of them.
+	verifyChecksum bool
+	checksumSample int
+	dryRun         bool
+
+	roles        bool
+	excludeRoles []string
+
+	allDatabases     bool
+	includePostgres  bool
+	excludeDatabases []string
+
+	ignoreMissingExtensions bool
+	skipSpaceCheck          bool
+	probeFreeSpace          bool
+	minFreeBytes            int64
+	allowSame               bool
+	allowSwapped            bool
+	force                   bool
+	allowPrimary            bool
+	strict                  bool
+
+	connect       connectOpts
+	waitForTarget time.Duration
+	requireSSL    bool
+	// sshTunnel is set when the source is reached through --ssh-tunnel, so
+	// its host is the local end of the forward.
+	sshTunnel bool
+
+	precheckTimeout  time.Duration
+	statementTimeout time.Duration
+	searchPath       string
+	continueOnError  bool
+
+	singleTransaction bool
+	timeout           time.Duration
+	verbose           bool
+	progress          bool
+	heartbeat         time.Duration
+	logFormat         string
+}
+
+// stringSlice is a flag.Value that accumulates each occurrence of a repeatable
+// flag.
+type stringSlice []string
+
+func (s *stringSlice) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringSlice) Set(value string) error {
+	*s = append(*s, value)
+	return nil
 }
 
 func main() {
-	ctx := context.Background()
+	ctx, interrupt := context.WithCancel(context.Background())
+	defer interrupt()
+	defer exitIfInterrupted()
 	log.SetFlags(0)
 
-	noOwner := flag.Bool("no-owner", true, "")
-	clean := flag.Bool("clean", true, "")
-	create := flag.Bool("create", true, "")
-	dataOnly := flag.Bool("data-only", false, "")
+	go handleSignals(interrupt)
 
+	f := registerFlags(flag.CommandLine)
 	flag.Parse()
 
+	// Flags given on the command line take precedence over the config file,
+	// which takes precedence over the environment.
+	if path := f.configPath; path != "" || os.Getenv(envName("config")) != "" {
+		if path == "" {
+			path = os.Getenv(envName("config"))
+		}
+		config, err := loadConfig(path, flag.CommandLine)
+		if err == nil {
+			err = config.apply(flag.CommandLine)
+		}
+		if err != nil {
+			log.Printf("[error] %s", err)
+			os.Exit(exitUsage)
+			return
+		}
+		// The connection strings are read from the environment with the rest
+		// of the secrets below.
+		if config.source != "" {
+			_ = os.Setenv("SOURCE_DATABASE_URI", config.source)
+		}
+		if config.target != "" {
+			_ = os.Setenv("TARGET_DATABASE_URI", config.target)
+		}
+	}
+	if err := applyEnvFlags(flag.CommandLine, os.Getenv); err != nil {
+		log.Printf("[error] %s", err)
+		os.Exit(exitUsage)
+		return
+	}
+
+	// All log output is passed through the redactor, which masks the source
+	// and target credentials once they're known.
+	var logOutput io.Writer = os.Stderr
+	switch f.logFormat {
+	case logFormatText:
+	case logFormatJSON:
+		logOutput = newJSONLogWriter(os.Stderr)
+	default:
+		log.Printf("[error] unsupported --log-format %q. expected text or json", f.logFormat)
+		os.Exit(exitUsage)
+		return
+	}
+	redactor := newRedactingWriter(logOutput)
+	log.SetOutput(redactor)
+	// Passwords may also come from the libpq environment, which pgx and the
+	// client tools both inherit.
+	redactor.addSecret(os.Getenv("PGPASSWORD"))
+	redactor.addSecret(os.Getenv("PGSSLPASSWORD"))
+
+	if err := validateFlags(f); err != nil {
+		log.Printf("[error] %s", err)
+		os.Exit(exitUsage)
+		return
+	}
+
+	// Listing an archive needs neither a source nor a target.
+	if f.list {
+		opts := migrationOpts{restoreFrom: f.restoreFrom}
+		resolveClientTools(&opts, f.pgVersion)
+		if err := listArchive(ctx, deps{runner: execRunner{}}, opts); err != nil {
+			log.Printf("[error] %s", err)
+			os.Exit(exitCode(err))
+		}
+		return
+	}
+
+	// A source is only needed when there's a database to dump.
 	sourceURI := os.Getenv("SOURCE_DATABASE_URI")
-	if sourceURI == "" {
+	if f.sourceService != "" {
+		if sourceURI != "" {
+			log.Println("[error] --source-service can't be combined with SOURCE_DATABASE_URI")
+			os.Exit(exitUsage)
+			return
+		}
+		sourceURI = serviceURI(f.sourceService)
+	}
+	if sourceURI == "" && f.restoreFrom == "" {
 		log.Printf("[error] SOURCE_DATABASE_URI secret must be set")
-		os.Exit(1)
+		os.Exit(exitUsage)
 		return
 	}
-
-	// Build Target URI from environment
-	operatorPass := os.Getenv("OPERATOR_PASSWORD")
-	if operatorPass == "" {
-		log.Println("[error] OPERATOR_PASSWORD secret must be set")
-		os.Exit(1)
+	tunnel, err := parseTunnel(f.sshTunnel, f.sshKey)
+	if err != nil {
+		log.Printf("[error] %s", err)
+		os.Exit(exitUsage)
+		return
+	}
+	if tunnel == nil && f.sshKey != "" {
+		log.Println("[error] --ssh-key requires --ssh-tunnel")
+		os.Exit(exitUsage)
+		return
+	}
+	if tunnel != nil && f.restoreFrom != "" {
+		log.Println("[error] --ssh-tunnel can't be combined with --restore-from, as there's no source to reach")
+		os.Exit(exitUsage)
 		return
 	}
 
-	appName := os.Getenv("FLY_APP_NAME")
-	if appName == "" {
-		log.Println("[error] FLY_APP_NAME environment variable must be set")
-		os.Exit(1)
+	if sourceURI != "" {
+		redactor.addURI(sourceURI)
+		if sourceURI, err = withSSL(sourceURI, f.ssl); err != nil {
+			log.Printf("[error] SOURCE_DATABASE_URI: %s", err)
+			os.Exit(exitUsage)
+			return
+		}
+		redactor.addURI(sourceURI)
+	}
+
+	var targetURI string
+	if f.targetService != "" {
+		if os.Getenv("TARGET_DATABASE_URI") != "" {
+			log.Println("[error] --target-service can't be combined with TARGET_DATABASE_URI")
+			os.Exit(exitUsage)
+			return
+		}
+		targetURI = serviceURI(f.targetService)
+	} else if targetURI, err = resolveTargetURI(os.Getenv); err != nil {
+		log.Printf("[error] %s", err)
+		os.Exit(exitUsage)
 		return
 	}
+	redactor.addURI(targetURI)
+	if targetURI, err = withSSL(targetURI, f.ssl); err != nil {
+		log.Printf("[error] target uri: %s", err)
+		os.Exit(exitUsage)
+		return
+	}
+	redactor.addURI(targetURI)
 
-	targetURI := fmt.Sprintf("postgres://postgres:%s@%s.internal:5432", operatorPass, appName)
+	// Services are looked up as connection strings are parsed, so parsing
+	// them up front reports a missing service before anything connects.
+	for _, uri := range []struct {
+		name  string
+		value string
+	}{
+		{"source", sourceURI},
+		{"target", targetURI},
+	} {
+		if uri.value == "" {
+			continue
+		}
+		conf, err := pgx.ParseConfig(uri.value)
+		if err != nil {
+			log.Printf("[error] invalid %s connection: %s", uri.name, err)
+			os.Exit(exitUsage)
+			return
+		}
+		// The password may have come from a service or password file.
+		redactor.addSecret(conf.Password)
+	}
 
 	opts := migrationOpts{
-		sourceURI: sourceURI,
-		targetURI: targetURI,
-		noOwner:   *noOwner,
-		clean:     *clean,
-		create:    *create,
-		dataOnly:  *dataOnly,
+		sourceURI:  sourceURI,
+		targetURI:  targetURI,
+		noOwner:    f.noOwner,
+		noACL:      f.noACL,
+		clean:      f.clean,
+		ifExists:   f.ifExists,
+		create:     f.create,
+		dataOnly:   f.dataOnly,
+		schemaOnly: f.schemaOnly,
+		sections:   f.sections,
+
+		noComments:    f.noComments,
+		noTablespaces: f.noTablespaces,
+		blobs:         f.blobs,
+		noBlobs:       f.noBlobs,
+		tablespaceMap: f.tablespaces,
+		ownerMap:      f.owners,
+
+		disableTriggers:      f.disableTriggers,
+		useList:              f.useList,
+		skipSuperuserObjects: f.skipSuperuserObjects,
+		deferConstraints:     f.deferConstraints,
+		fastRestore:          f.fastRestore,
+		vacuum:               f.vacuum,
+		reindex:              f.reindex,
+		resetSequences:       f.resetSeqs,
+		analyze:              f.analyze,
+		refreshMatviews:      f.refreshMatviews,
+		grantTo:              f.grantTo,
+		yes:                  f.yes || f.force,
+		format:               f.format,
+		engine:               f.engine,
+		tempDir:              f.tempDir,
+		dumpFile:             f.dumpFile,
+		keepDump:             f.keepDump,
+		restoreFrom:          f.restoreFrom,
+		dumpTo:               f.dumpLocation,
+		noRestore:            f.noRestore,
+		pgVersion:            f.pgVersion,
+		pgDumpPath:           f.pgDumpPath,
+		psqlPath:             f.psqlPath,
+		jobs:                 f.jobs,
+		parallel:             f.parallel > 0,
+		compress:             f.compression,
+
+		snapshot:               f.snapshot,
+		serializableDeferrable: f.serializableDeferrable,
+		maxRate:                f.rate,
+
+		schemas:        f.schemas,
+		excludeSchemas: f.excludeSchemas,
+		tables:         f.tables,
+		excludeTables:  f.excludeTables,
+
+		skipVerify:     f.skipVerify,
+		verifySchema:   f.verifySchema,
+		verifyChecksum: f.verifyChecksum,
+		checksumSample: f.checksumSample,
+		dryRun:         f.dryRun,
+
+		roles:        f.roles,
+		excludeRoles: f.excludeRoles,
+
+		allDatabases:     f.allDatabases,
+		includePostgres:  f.includePostgres,
+		excludeDatabases: f.excludeDatabases,
+
+		ignoreMissingExtensions: f.ignoreMissingExtensions,
+		skipSpaceCheck:          f.skipSpaceCheck,
+		probeFreeSpace:          f.probeFreeSpace,
+		minFreeBytes:            f.minFreeBytes,
+		allowSame:               f.allowSame,
+		allowSwapped:            f.allowSwapped,
+		force:                   f.force,
+		allowPrimary:            f.allowPrimary,
+		strict:                  f.strict,
+
+		connect: connectOpts{
+			retries:    f.connectRetries,
+			retryDelay: f.connectRetryDelay,
+			timeout:    f.connectTimeout,
+		},
+		waitForTarget: f.waitForTarget,
+		requireSSL:    f.requireSSL,
+		sshTunnel:     tunnel != nil,
+
+		precheckTimeout:  f.precheckTimeout,
+		statementTimeout: f.statementTimeout,
+		lockWaitTimeout:  f.lockWaitTimeout,
+		searchPath:       f.searchPathValue,
+		continueOnError:  f.continueOnError,
+
+		singleTransaction: f.singleTransaction,
+		timeout:           f.timeout,
+		verbose:           f.verbose,
+		progress:          f.progress,
+		heartbeat:         f.heartbeat,
+		logFormat:         f.logFormat,
+	}
+
+	d := deps{
+		runner: execRunner{},
+		opener: pgxOpener{opts: opts.connect},
+	}
+	if opts.dumpTo != nil {
+		if d.s3, err = newS3ClientFromEnv(os.Getenv); err != nil {
+			log.Printf("[error] %s", err)
+			os.Exit(exitUsage)
+			return
+		}
+		redactor.addSecret(d.s3.secretKey)
+		redactor.addSecret(d.s3.sessionToken)
+	}
+
+	if f.logFile != "" {
+		if err := commandLog.open(f.logFile, redactor.redact); err != nil {
+			log.Printf("[error] %s", err)
+			os.Exit(exitUsage)
+			return
+		}
+		defer commandLog.close()
+	}
+
+	printOptions(opts)
+
+	// The tunnel is started before anything connects to the source, so both
+	// the pre-checks and pg_dump go through it.
+	if tunnel != nil {
+		log.Printf("[info] Opening SSH tunnel to the source via %s...", f.sshTunnel)
+		t, uri, err := startTunnel(ctx, d.runner, *tunnel, opts.sourceURI)
+		if err != nil {
+			log.Printf("[error] failed to open ssh tunnel: %s", err)
+			exit(exitConnectivity)
+			return
+		}
+		defer t.Close()
+		redactor.addURI(uri)
+		opts.sourceURI = uri
+	}
+
+	start := time.Now()
+	summary := &migrationSummary{}
+
+	if opts.allDatabases {
+		migrationCtx, cancel := ctx, context.CancelFunc(func() {})
+		if opts.timeout > 0 {
+			migrationCtx, cancel = context.WithTimeout(ctx, opts.timeout)
+		}
+		err := importAllDatabases(migrationCtx, d, opts, summary)
+		timedOut := errors.Is(migrationCtx.Err(), context.DeadlineExceeded)
+		cancel()
+
+		summary.Duration = time.Since(start).Seconds()
+		if !opts.dryRun {
+			printSummary(summary, opts.logFormat)
+		}
+		switch {
+		case timedOut:
+			log.Printf("[error] import timed out after %s: %s", opts.timeout, err)
+			exit(exitTimeout)
+		case err != nil:
+			log.Printf("[error] %s", err)
+			exit(exitCode(err))
+		case opts.dryRun:
+			log.Println("[info] Dry run complete, nothing was imported")
+		default:
+			log.Println("[info] Import complete!")
+		}
+		return
 	}
 
+	setPhase(phasePrechecks)
 	log.Println("[info] Running pre-checks...")
-	if err := runPreChecks(ctx, opts); err != nil {
+	if err := runPreChecks(ctx, d, &opts, summary); err != nil {
 		log.Printf("[error] %s", err)
-		os.Exit(1)
+		exit(exitCode(err))
 		return
 	}
 	log.Println("[info] Pre-checks completed without issue")
 
+	if opts.dryRun {
+		if err := printPlan(ctx, d, opts); err != nil {
+			log.Printf("[error] %s", err)
+			exit(exitCode(err))
+			return
+		}
+		log.Println("[info] Dry run complete, nothing was imported")
+		return
+	}
+
+	if opts.clean && !opts.yes {
+		if err := confirmClean(opts); err != nil {
+			log.Printf("[error] %s", err)
+			exit(exitCode(err))
+			return
+		}
+	}
+
 	log.Println("[info] Starting import process... (This could take a while)")
-	if err := runMigration(ctx, opts); err != nil {
+	migrationCtx, cancel := ctx, context.CancelFunc(func() {})
+	if opts.timeout > 0 {
+		migrationCtx, cancel = context.WithTimeout(ctx, opts.timeout)
+	}
+	result, err := runMigration(migrationCtx, d, opts)
+	summary.addResult(result)
+	timedOut := errors.Is(migrationCtx.Err(), context.DeadlineExceeded)
+	cancel()
+	if err != nil {
+		if timedOut {
+			log.Printf("[error] import timed out after %s: %s", opts.timeout, err)
+			exit(exitTimeout)
+			return
+		}
 		log.Printf("[error] %s", err)
-		os.Exit(1)
+		exit(exitCode(err))
 		return
 	}
 	log.Println("[info] Import complete!")
-}
 
-func runPreChecks(ctx context.Context, opts migrationOpts) error {
-	// Verify source URI specifies a database.
-	sourceConf, err := pgx.ParseConfig(opts.sourceURI)
-	if err != nil {
-		return fmt.Errorf("failed to parse source uri: %s", err)
+	if err := runPostRestore(ctx, d, opts, summary); err != nil {
+		log.Printf("[error] %s", err)
+		exit(exitCode(err))
+		return
 	}
-	if sourceConf.Database == "" {
-		return fmt.Errorf("source-uri must contain a database reference (e.g. postgres://<user>:<pass>@<host>:<port>/<database>)")
+
+	if summary.Database == "" {
+		if uri, err := restoredTargetURI(opts); err == nil {
+			if conf, err := pgx.ParseConfig(uri); err == nil {
+				summary.Database = conf.Database
+			}
+		}
 	}
+	summary.Duration = time.Since(start).Seconds()
+	printSummary(summary, opts.logFormat)
+}
 
-	// Check source connectivity
-	sourceConn, err := openConnection(ctx, opts.sourceURI)
-	if err != nil {
-		return fmt.Errorf("failed to connect to source: %s", err)
+// resolveTargetURI determines the target from the environment. An explicit
+// TARGET_DATABASE_URI takes precedence, otherwise the URI is derived from the
+// Fly app name and operator password.
+func resolveTargetURI(getenv func(string) string) (string, error) {
+	if targetURI := getenv("TARGET_DATABASE_URI"); targetURI != "" {
+		return targetURI, nil
 	}
-	defer func() { _ = sourceConn.Close(ctx) }()
 
-	// Check target connectivity
-	targetConn, err := openConnection(ctx, opts.targetURI)
-	if err != nil {
-		return fmt.Errorf("failed to connect to target: %s", err)
+	operatorPass := getenv("OPERATOR_PASSWORD")
+	if operatorPass == "" {
+		return "", fmt.Errorf("OPERATOR_PASSWORD secret must be set")
 	}
-	defer func() { _ = targetConn.Close(ctx) }()
 
-	// Verify source version is not greater than the target
-	var sourceVersion string
-	if err := sourceConn.QueryRow(ctx, "SHOW server_version;").Scan(&sourceVersion); err != nil {
-		return fmt.Errorf("failed to query source version: %s", err)
+	appName := getenv("FLY_APP_NAME")
+	if appName == "" {
+		return "", fmt.Errorf("FLY_APP_NAME environment variable must be set")
 	}
-	log.Println("[info] Source Postgres version: " + sourceVersion)
 
-	var targetVersion string
-	if err := targetConn.QueryRow(ctx, "SHOW server_version;").Scan(&targetVersion); err != nil {
-		return fmt.Errorf("failed to query target version: %s", err)
+	// The password is escaped, as it may contain characters such as @ or /.
+	u := url.URL{
+		Scheme: "postgres",
+		User:   url.UserPassword("postgres", operatorPass),
+		Host:   appName + ".internal:5432",
 	}
-	log.Println("[info] Target Postgres version: " + targetVersion)
+	return u.String(), nil
+}
 
-	sourceSlice := strings.Split(sourceVersion, ".")
-	targetSlice := strings.Split(targetVersion, ".")
+// serviceURI returns a connection string referring to the named connection
+// service.
+func serviceURI(service string) string {
+	return "service='" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(service) + "'"
+}
 
-	if sourceSlice[0] > targetSlice[0] {
-		return fmt.Errorf("source is running a more recent version than target. expected >= %s, got %s", targetVersion, sourceVersion)
+// restoredTargetURI returns the URI of the database the import is restored
+// into. With --create, pg_dump recreates the source database by name on the
+// target, so that database is used instead of the one the target URI names.
+func restoredTargetURI(opts migrationOpts) (string, error) {
+	if !opts.create {
+		return opts.targetURI, nil
 	}
 
-	return nil
+	sourceConf, err := pgx.ParseConfig(opts.sourceURI)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse source uri: %w", err)
+	}
+
+	return withDatabase(opts.targetURI, sourceConf.Database)
 }
 
-func runMigration(ctx context.Context, opts migrationOpts) error {
-	dumpStr := fmt.Sprintf("pg_dump -d %s", opts.sourceURI)
-	if opts.noOwner {
-		dumpStr = dumpStr + " --no-owner"
+// withDatabase returns uri with its database replaced by database. Both URL
+// and keyword/value connection strings are supported.
+func withDatabase(uri, database string) (string, error) {
+	if strings.HasPrefix(uri, "postgres://") || strings.HasPrefix(uri, "postgresql://") {
+		u, err := url.Parse(uri)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse uri: %w", err)
+		}
+		u.Path = "/" + database
+		return u.String(), nil
 	}
-	if opts.clean {
-		dumpStr = dumpStr + " --clean"
+
+	// Later keywords take precedence over earlier ones.
+	quoted := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(database)
+	return fmt.Sprintf("%s dbname='%s'", uri, quoted), nil
+}
+
+// quoteLiteral quotes s as a SQL string literal.
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// parseCompression validates a --compress value, returning it in the form
+// accepted by pg_dump's --compress option.
+func parseCompression(value string) (string, error) {
+	if value == "" {
+		return "", nil
 	}
-	if opts.create {
-		dumpStr = dumpStr + " --create"
+
+	if value == "zstd" || strings.HasPrefix(value, "zstd:") {
+		if level, ok := strings.CutPrefix(value, "zstd:"); ok {
+			n, err := strconv.Atoi(level)
+			if err != nil || n < 1 || n > 22 {
+				return "", fmt.Errorf("invalid --compress %q. zstd levels range from 1 to 22", value)
+			}
+		}
+		return value, nil
 	}
-	if opts.dataOnly {
-		dumpStr = dumpStr + " --data-only"
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 || n > 9 {
+		return "", fmt.Errorf("invalid --compress %q. expected a level from 0 to 9 or zstd[:LEVEL]", value)
 	}
+	return strconv.Itoa(n), nil
+}
 
-	restoreStr := fmt.Sprintf("psql -d %s", opts.targetURI)
-	cmd := fmt.Sprintf("%s | %s", dumpStr, restoreStr)
+// searchPathSchema matches a single schema in a --search-path, either a bare
+// name or a quoted one such as "$user".
+var searchPathSchema = regexp.MustCompile(`^(?:[A-Za-z_][A-Za-z0-9_$]*|"[A-Za-z0-9_$-]+")$`)
 
-	if _, err := runCommand(cmd); err != nil {
-		return fmt.Errorf("failed to import database: %s", err)
+// parseSearchPath validates a --search-path value, returning it without
+// spaces. It's passed to the restore through PGOPTIONS, which splits on
+// spaces and doesn't quote, so only plain schema names are accepted.
+func parseSearchPath(value string) (string, error) {
+	if value == "" {
+		return "", nil
 	}
 
-	return nil
+	schemas := strings.Split(value, ",")
+	for i, schema := range schemas {
+		schemas[i] = strings.TrimSpace(schema)
+		if !searchPathSchema.MatchString(schemas[i]) {
+			return "", fmt.Errorf("invalid --search-path %q. expected comma-separated schema names of letters, digits and underscores", value)
+		}
+	}
+	return strings.Join(schemas, ","), nil
 }
 
-func openConnection(parentCtx context.Context, uri string) (*pgx.Conn, error) {
-	ctx, cancel := context.WithTimeout(parentCtx, 10*time.Second)
-	defer cancel()
+// parseByteSize parses a byte count with an optional binary K, M or G suffix.
+// An empty value is zero.
+func parseByteSize(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
 
-	conf, err := pgx.ParseConfig(uri)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse uri: %s", err)
+	multiplier := int64(1)
+	switch strings.ToUpper(value[len(value)-1:]) {
+	case "K":
+		multiplier = 1 << 10
+	case "M":
+		multiplier = 1 << 20
+	case "G":
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		value = value[:len(value)-1]
 	}
 
-	conf.ConnectTimeout = 5 * time.Second
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%q is not a byte count", value)
+	}
+	return n * multiplier, nil
+}
 
-	return pgx.ConnectConfig(ctx, conf)
+// parseMappings parses the OLD=NEW values of a repeatable mapping flag.
+func parseMappings(name string, values []string) (map[string]string, error) {
+	mappings := make(map[string]string, len(values))
+	for _, value := range values {
+		from, to, ok := strings.Cut(value, "=")
+		if !ok || from == "" || to == "" {
+			return nil, fmt.Errorf("invalid --%s %q. expected OLD=NEW", name, value)
+		}
+		if _, ok := mappings[from]; ok {
+			return nil, fmt.Errorf("--%s maps %q more than once", name, from)
+		}
+		mappings[from] = to
+	}
+	return mappings, nil
 }
 
-func runCommand(cmdStr string) ([]byte, error) {
-	cmd := exec.Command("sh", "-c", cmdStr)
-	cmd.SysProcAttr = &syscall.SysProcAttr{}
+// rewritesScript reports whether the restore script must be rewritten to remap
+// tablespaces or owners, or to defer constraints. Archives are then converted
+// to SQL and applied with psql rather than restored with pg_restore.
+func rewritesScript(opts migrationOpts) bool {
+	return len(opts.tablespaceMap) > 0 || len(opts.ownerMap) > 0 || opts.deferConstraints
+}
 
-	return cmd.Output()
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
 }
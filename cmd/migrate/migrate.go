@@ -0,0 +1,481 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// migrationResult describes what an import transferred.
+type migrationResult struct {
+	// Tables and Rows are only counted by the pgx engine. Otherwise they're
+	// left to verification.
+	Tables       int
+	Rows         int64
+	Bytes        int64
+	Duration     time.Duration
+	TableTimings []tableTiming
+}
+
+// tableTiming reports how long a single table took to copy.
+type tableTiming struct {
+	Table string `json:"table"`
+	Rows  int64  `json:"rows"`
+	Bytes int64  `json:"bytes"`
+	// Duration is measured in seconds.
+	Duration float64 `json:"duration_seconds"`
+}
+
+// runMigration dumps the source, or opens the existing dump, and restores it
+// into the target.
+func runMigration(ctx context.Context, d deps, opts migrationOpts) (migrationResult, error) {
+	start := time.Now()
+	if opts.heartbeat > 0 {
+		defer startHeartbeat(opts.heartbeat, start)()
+	}
+	var result migrationResult
+	err := transfer(ctx, d, opts, &result)
+	result.Duration = time.Since(start)
+	return result, err
+}
+
+func transfer(ctx context.Context, d deps, opts migrationOpts, result *migrationResult) error {
+	if opts.fastRestore && !opts.noRestore {
+		log.Printf("[info] Restoring with maintenance_work_mem=%s and synchronous_commit=off", fastRestoreMaintenanceWorkMem)
+		restore, err := raiseMaxWALSize(ctx, d, opts)
+		if err != nil {
+			return err
+		}
+		defer restore()
+	}
+
+	if opts.restoreFrom != "" {
+		return restoreExisting(ctx, d, opts, result)
+	}
+
+	if opts.roles {
+		setPhase(phaseRoles)
+		log.Println("[info] Copying roles...")
+		if err := migrateRoles(ctx, d, opts); err != nil {
+			return err
+		}
+	}
+
+	// Used as the denominator when reporting how far through the dump is.
+	total := estimateDumpSize(ctx, d, opts)
+
+	if opts.engine == enginePgx {
+		setPhase(phaseRestore)
+		return copyWithPgx(ctx, d, opts, total, result)
+	}
+
+	var upload *s3Upload
+	if opts.dumpTo != nil {
+		var err error
+		if upload, err = newS3Upload(ctx, d.s3, *opts.dumpTo); err != nil {
+			return err
+		}
+		defer upload.Abort()
+
+		if opts.noRestore {
+			setPhase(phaseDump)
+			return uploadDump(ctx, d, opts, upload, total, result)
+		}
+	}
+
+	if opts.format == formatPlain {
+		// The dump is streamed into the restore, so both run concurrently
+		// and are reported as the restore phase.
+		setPhase(phaseRestore)
+		counter := &countingWriter{w: io.Discard}
+		dump := newStage(opts.pgDumpPath, dumpArgs(opts)...)
+		dump.class = ErrDumpFailed
+		dump.output = func(w io.Writer) io.Writer {
+			w = io.MultiWriter(w, counter)
+			if upload != nil {
+				w = io.MultiWriter(w, upload)
+			}
+			return throttle(opts, w)
+		}
+		restore := newRestoreStage(opts, opts.psqlPath, restoreArgs(opts)...)
+		restore.class = ErrRestoreFailed
+		if rewritesScript(opts) {
+			restore.input = func(r io.Reader) io.Reader {
+				return rewriteScript(opts, r)
+			}
+		}
+
+		stop := startProgress(total, counter.Count)
+		stopMonitor := startCopyMonitor(ctx, d, opts)
+		n, err := runPipeline(ctx, d.runner, dump, restore)
+		stopMonitor()
+		stop()
+		if err != nil {
+			return fmt.Errorf("failed to import database: %w", err)
+		}
+		result.Bytes = n
+
+		if upload != nil {
+			return upload.Close()
+		}
+		return nil
+	}
+
+	path := opts.dumpFile
+	if path == "" {
+		// Archive formats can't be streamed into pg_restore, so dump to a
+		// temporary location first. It's removed regardless of the outcome.
+		dir, err := os.MkdirTemp(opts.tempDir, "pg-import-")
+		if err != nil {
+			return fmt.Errorf("failed to create temp directory: %w", err)
+		}
+		children.addPath(dir)
+		defer func() {
+			_ = os.RemoveAll(dir)
+			children.removePath(dir)
+		}()
+
+		path = filepath.Join(dir, "dump")
+	}
+
+	// An existing --dump-file is the product of an earlier run, so only the
+	// restore needs repeating.
+	if _, err := os.Stat(path); opts.dumpFile != "" && err == nil {
+		log.Printf("[info] Restoring from existing dump %s", path)
+	} else {
+		setPhase(phaseDump)
+		if err := dumpArchive(ctx, d, opts, path, total); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	if result.Bytes, err = pathSize(path); err != nil {
+		log.Printf("[warn] failed to determine dump size: %s", err)
+	} else {
+		log.Printf("[info] Dump size: %d bytes", result.Bytes)
+	}
+
+	// The archive is uploaded before restoring, so it's available as a
+	// checkpoint even if the restore fails.
+	if upload != nil {
+		if err := uploadFile(upload, path); err != nil {
+			return err
+		}
+	}
+
+	setPhase(phaseRestore)
+	defer startCopyMonitor(ctx, d, opts)()
+
+	if len(opts.superuserObjects) > 0 {
+		list, remove, err := writeRestoreList(ctx, d, opts, path)
+		if err != nil {
+			return err
+		}
+		defer remove()
+		opts.useList = list
+	}
+
+	if rewritesScript(opts) {
+		// Tablespaces and owners are rewritten in the SQL pg_restore
+		// generates, which is then applied with psql as for a plain dump.
+		restore := newStage(opts.pgRestorePath, pgRestoreScriptArgs(opts, path)...)
+		apply := newRestoreStage(opts, opts.psqlPath, restoreArgs(opts)...)
+		apply.input = func(r io.Reader) io.Reader {
+			return rewriteScript(opts, r)
+		}
+		if _, err := runPipeline(ctx, d.runner, restore, apply); err != nil {
+			return classify(ErrRestoreFailed, fmt.Errorf("failed to restore database: %w", err))
+		}
+		removeDumpFile(opts)
+		return nil
+	}
+
+	restore := newRestoreStage(opts, opts.pgRestorePath, pgRestoreArgs(opts, path)...)
+	if err := restore.run(ctx, d.runner); err != nil {
+		return classify(ErrRestoreFailed, fmt.Errorf("failed to restore database: %w", err))
+	}
+
+	removeDumpFile(opts)
+
+	return nil
+}
+
+// uploadDump streams pg_dump's output straight into upload without restoring
+// it.
+func uploadDump(ctx context.Context, d deps, opts migrationOpts, upload *s3Upload, total int64, result *migrationResult) error {
+	counter := &countingWriter{w: upload}
+	dump := newStage(opts.pgDumpPath, dumpArgs(opts)...)
+	dump.class = ErrDumpFailed
+	dump.cmd.stdout = throttle(opts, counter)
+	stop := startProgress(total, counter.Count)
+	err := dump.run(ctx, d.runner)
+	stop()
+	if err != nil {
+		return fmt.Errorf("failed to dump database: %w", err)
+	}
+	result.Bytes = counter.Count()
+
+	return upload.Close()
+}
+
+// uploadFile copies the dump at path into upload and completes it.
+func uploadFile(upload *s3Upload, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open dump: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	if _, err := io.Copy(upload, f); err != nil {
+		return fmt.Errorf("failed to upload dump: %w", err)
+	}
+	return upload.Close()
+}
+
+// dumpArchive dumps the source to path. A --dump-file is written under a
+// temporary name and only moved into place once complete, so an interrupted
+// dump is never mistaken for a finished one on the next run. Progress is
+// reported from the size of the archive written so far.
+func dumpArchive(ctx context.Context, d deps, opts migrationOpts, path string, total int64) error {
+	output := path
+	if opts.dumpFile != "" {
+		output = path + ".partial"
+		if err := os.RemoveAll(output); err != nil {
+			return fmt.Errorf("failed to remove stale dump %s: %w", output, err)
+		}
+		children.addPath(output)
+		defer func() {
+			_ = os.RemoveAll(output)
+			children.removePath(output)
+		}()
+	}
+
+	stop := startProgress(total, func() int64 {
+		n, _ := pathSize(output)
+		return n
+	})
+	err := runArchiveDump(ctx, d, opts, output)
+	stop()
+	if err != nil {
+		return err
+	}
+
+	if output != path {
+		if err := os.Rename(output, path); err != nil {
+			return fmt.Errorf("failed to move dump into place: %w", err)
+		}
+		log.Printf("[info] Dump written to %s", path)
+	}
+
+	return nil
+}
+
+// runArchiveDump runs pg_dump, writing the archive to path. When the dump is
+// rate limited, pg_dump writes to stdout instead so the output can be
+// throttled on its way to the file.
+func runArchiveDump(ctx context.Context, d deps, opts migrationOpts, path string) error {
+	if opts.maxRate <= 0 {
+		dump := newStage(opts.pgDumpPath, append(dumpArgs(opts), "-f", path)...)
+		dump.class = ErrDumpFailed
+		if err := dump.run(ctx, d.runner); err != nil {
+			return fmt.Errorf("failed to dump database: %w", err)
+		}
+		return nil
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create dump: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	dump := newStage(opts.pgDumpPath, dumpArgs(opts)...)
+	dump.class = ErrDumpFailed
+	dump.cmd.stdout = throttle(opts, f)
+	if err := dump.run(ctx, d.runner); err != nil {
+		return fmt.Errorf("failed to dump database: %w", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write dump: %w", err)
+	}
+	return nil
+}
+
+// removeDumpFile deletes the --dump-file once it has been restored, unless
+// --keep-dump was given.
+func removeDumpFile(opts migrationOpts) {
+	if opts.dumpFile == "" || opts.keepDump {
+		return
+	}
+	if err := os.RemoveAll(opts.dumpFile); err != nil {
+		log.Printf("[warn] failed to remove dump %s: %s", opts.dumpFile, err)
+		return
+	}
+	log.Printf("[info] Removed dump %s", opts.dumpFile)
+}
+
+// dumpArgs builds the pg_dump arguments for the configured options. URIs are
+// passed as discrete arguments rather than through a shell, so credentials
+// containing shell metacharacters are handed to pg_dump verbatim.
+func dumpArgs(opts migrationOpts) []string {
+	args := []string{"-d", opts.sourceURI, "--format=" + opts.format}
+	if opts.verbose {
+		args = append(args, "--verbose")
+	}
+	if opts.compress != "" {
+		args = append(args, "--compress="+opts.compress)
+	}
+	// Directory dumps can also be written in parallel, in which case pg_dump
+	// synchronizes every worker on the leader's snapshot.
+	if opts.format == formatDirectory && opts.jobs > 1 {
+		args = append(args, "--jobs="+strconv.Itoa(opts.jobs))
+	}
+	if opts.snapshot != "" {
+		args = append(args, "--snapshot="+opts.snapshot)
+	}
+	if opts.serializableDeferrable {
+		args = append(args, "--serializable-deferrable")
+	}
+	if opts.lockWaitTimeout > 0 {
+		args = append(args, "--lock-wait-timeout="+strconv.FormatInt(opts.lockWaitTimeout.Milliseconds(), 10))
+	}
+	if opts.dataOnly {
+		args = append(args, "--data-only")
+	}
+	if opts.schemaOnly {
+		args = append(args, "--schema-only")
+	}
+	for _, section := range opts.sections {
+		args = append(args, "--section="+section)
+	}
+	for _, schema := range opts.schemas {
+		args = append(args, "--schema="+schema)
+	}
+	for _, schema := range opts.excludeSchemas {
+		args = append(args, "--exclude-schema="+schema)
+	}
+	for _, table := range opts.tables {
+		args = append(args, "--table="+table)
+	}
+	for _, table := range opts.excludeTables {
+		args = append(args, "--exclude-table="+table)
+	}
+	if opts.blobs {
+		args = append(args, "--blobs")
+	}
+	if opts.noBlobs {
+		args = append(args, "--no-blobs")
+	}
+
+	// pg_dump ignores these when writing an archive; pg_restore applies them
+	// instead.
+	if opts.format == formatPlain {
+		args = append(args, objectArgs(opts)...)
+	}
+
+	return args
+}
+
+// restoreArgs builds the psql arguments used to apply a plain dump to the
+// target.
+func restoreArgs(opts migrationOpts) []string {
+	// Errors are reported with their SQLSTATE along with the statement that
+	// caused them, so a failure can be diagnosed from the error alone.
+	args := []string{"-d", opts.targetURI, "-v", "VERBOSITY=verbose", "--echo-errors"}
+	if !opts.continueOnError {
+		args = append(args, "-v", "ON_ERROR_STOP=1")
+	}
+	if opts.singleTransaction {
+		args = append(args, "--single-transaction")
+	}
+
+	return args
+}
+
+// pgRestoreArgs builds the pg_restore arguments used to apply the archive at
+// path to the target.
+func pgRestoreArgs(opts migrationOpts, path string) []string {
+	args := []string{"-d", opts.targetURI}
+	if !opts.continueOnError {
+		args = append(args, "--exit-on-error")
+	}
+	if opts.singleTransaction {
+		args = append(args, "--single-transaction")
+	}
+	if opts.verbose {
+		args = append(args, "--verbose")
+	}
+	if opts.jobs > 1 {
+		args = append(args, "--jobs="+strconv.Itoa(opts.jobs))
+	}
+	if opts.useList != "" {
+		args = append(args, "--use-list="+opts.useList)
+	}
+	args = append(args, objectArgs(opts)...)
+
+	// pg_restore reads the archive from stdin when no path is given.
+	if path != "" {
+		args = append(args, path)
+	}
+	return args
+}
+
+// pgRestoreScriptArgs builds the pg_restore arguments used to convert the
+// archive at path into a SQL script on stdout.
+func pgRestoreScriptArgs(opts migrationOpts, path string) []string {
+	args := []string{"-f", "-"}
+	if opts.verbose {
+		args = append(args, "--verbose")
+	}
+	if opts.useList != "" {
+		args = append(args, "--use-list="+opts.useList)
+	}
+	args = append(args, objectArgs(opts)...)
+
+	// pg_restore reads the archive from stdin when no path is given.
+	if path != "" {
+		args = append(args, path)
+	}
+	return args
+}
+
+// objectArgs returns the options controlling how objects are recreated, which
+// both pg_dump (plain format) and pg_restore accept.
+func objectArgs(opts migrationOpts) []string {
+	var args []string
+	if opts.noOwner {
+		args = append(args, "--no-owner")
+	}
+	if opts.noACL {
+		args = append(args, "--no-acl")
+	}
+	if opts.noComments {
+		args = append(args, "--no-comments")
+	}
+	if opts.noTablespaces {
+		args = append(args, "--no-tablespaces")
+	}
+	if opts.clean {
+		args = append(args, "--clean")
+		// Objects that don't exist on the target yet are skipped rather than
+		// failing the restore under ON_ERROR_STOP.
+		if opts.ifExists {
+			args = append(args, "--if-exists")
+		}
+	}
+	if opts.create {
+		args = append(args, "--create")
+	}
+	if opts.disableTriggers {
+		args = append(args, "--disable-triggers")
+	}
+
+	return args
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// resolvedOptions is the effective configuration of an import once flags,
+// the config file and the environment have been combined.
+type resolvedOptions struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+	Engine string `json:"engine"`
+	Format string `json:"format"`
+	Jobs   int    `json:"jobs"`
+	// Enabled lists the flags in effect, by name.
+	Enabled          []string          `json:"enabled"`
+	Sections         []string          `json:"sections,omitempty"`
+	Schemas          []string          `json:"schemas,omitempty"`
+	ExcludeSchemas   []string          `json:"exclude_schemas,omitempty"`
+	Tables           []string          `json:"tables,omitempty"`
+	ExcludeTables    []string          `json:"exclude_tables,omitempty"`
+	ExcludeRoles     []string          `json:"exclude_roles,omitempty"`
+	ExcludeDatabases []string          `json:"exclude_databases,omitempty"`
+	OwnerMap         map[string]string `json:"owner_map,omitempty"`
+	TablespaceMap    map[string]string `json:"tablespace_map,omitempty"`
+	GrantTo          string            `json:"grant_to,omitempty"`
+	DumpTo           string            `json:"dump_to,omitempty"`
+	UseList          string            `json:"use_list,omitempty"`
+	SearchPath       string            `json:"search_path,omitempty"`
+	Timeout          string            `json:"timeout,omitempty"`
+}
+
+// resolveOptions describes opts for printOptions. Connections are reduced to
+// their user, host and database, so no credentials are included.
+func resolveOptions(opts migrationOpts) resolvedOptions {
+	r := resolvedOptions{
+		Source:           describeConnection(opts.sourceURI),
+		Target:           describeConnection(opts.targetURI),
+		Engine:           opts.engine,
+		Format:           opts.format,
+		Jobs:             opts.jobs,
+		Sections:         opts.sections,
+		Schemas:          opts.schemas,
+		ExcludeSchemas:   opts.excludeSchemas,
+		Tables:           opts.tables,
+		ExcludeTables:    opts.excludeTables,
+		ExcludeRoles:     opts.excludeRoles,
+		ExcludeDatabases: opts.excludeDatabases,
+		OwnerMap:         opts.ownerMap,
+		TablespaceMap:    opts.tablespaceMap,
+		GrantTo:          opts.grantTo,
+		UseList:          opts.useList,
+		SearchPath:       opts.searchPath,
+	}
+	if opts.restoreFrom != "" {
+		r.Source = displaySource(opts.restoreFrom)
+	}
+	if opts.dumpTo != nil {
+		r.DumpTo = opts.dumpTo.String()
+	}
+	if opts.timeout > 0 {
+		r.Timeout = opts.timeout.String()
+	}
+
+	for _, option := range []struct {
+		name string
+		set  bool
+	}{
+		{"no-owner", opts.noOwner},
+		{"no-acl", opts.noACL},
+		{"clean", opts.clean},
+		{"if-exists", opts.clean && opts.ifExists},
+		{"create", opts.create},
+		{"data-only", opts.dataOnly},
+		{"schema-only", opts.schemaOnly},
+		{"no-comments", opts.noComments},
+		{"no-tablespaces", opts.noTablespaces},
+		{"blobs", opts.blobs},
+		{"no-blobs", opts.noBlobs},
+		{"disable-triggers", opts.disableTriggers},
+		{"skip-superuser-objects", opts.skipSuperuserObjects},
+		{"defer-constraints", opts.deferConstraints},
+		{"fast-restore", opts.fastRestore},
+		{"reset-sequences", resetsSequences(opts)},
+		{"analyze", opts.analyze},
+		{"vacuum", opts.vacuum},
+		{"reindex", opts.reindex},
+		{"refresh-matviews", opts.refreshMatviews},
+		{"roles", opts.roles},
+		{"parallel", opts.parallel},
+		{"all-databases", opts.allDatabases},
+		{"include-postgres", opts.includePostgres},
+		{"single-transaction", opts.singleTransaction},
+		{"continue-on-error", opts.continueOnError},
+		{"serializable-deferrable", opts.serializableDeferrable},
+		{"no-restore", opts.noRestore},
+		{"keep-dump", opts.keepDump},
+		{"skip-verify", opts.skipVerify},
+		{"verify-schema", opts.verifySchema},
+		{"verify-checksum", opts.verifyChecksum},
+		{"dry-run", opts.dryRun},
+		{"yes", opts.yes},
+		{"force", opts.force},
+		{"allow-same", opts.allowSame},
+		{"allow-swapped", opts.allowSwapped},
+		{"allow-primary", opts.allowPrimary},
+		{"strict", opts.strict},
+		{"require-ssl", opts.requireSSL},
+		{"ssh-tunnel", opts.sshTunnel},
+	} {
+		if option.set {
+			r.Enabled = append(r.Enabled, option.name)
+		}
+	}
+
+	return r
+}
+
+// printOptions logs the resolved options, so it's clear which behavior the
+// import will have before anything is run. Under --log-format=json they're
+// emitted as a single structured event instead.
+func printOptions(opts migrationOpts) {
+	r := resolveOptions(opts)
+	if opts.logFormat == logFormatJSON {
+		b, err := json.Marshal(r)
+		if err != nil {
+			log.Printf("[warn] failed to encode options: %s", err)
+			return
+		}
+		log.Printf("[event:options] %s", b)
+		return
+	}
+
+	enabled := "none"
+	if len(r.Enabled) > 0 {
+		enabled = "--" + strings.Join(r.Enabled, " --")
+	}
+	engine := fmt.Sprintf("%s (format %s, jobs %d)", r.Engine, r.Format, r.Jobs)
+	if r.Engine == enginePgx {
+		engine = fmt.Sprintf("%s (jobs %d)", r.Engine, r.Jobs)
+	}
+
+	rows := [][]string{
+		{"Source:", r.Source},
+		{"Target:", r.Target},
+		{"Engine:", engine},
+		{"Enabled:", enabled},
+	}
+	for _, list := range []struct {
+		label  string
+		values []string
+	}{
+		{"Sections:", r.Sections},
+		{"Schemas:", r.Schemas},
+		{"Excluded schemas:", r.ExcludeSchemas},
+		{"Tables:", r.Tables},
+		{"Excluded tables:", r.ExcludeTables},
+		{"Excluded roles:", r.ExcludeRoles},
+		{"Excluded databases:", r.ExcludeDatabases},
+		{"Owner map:", formatMapping(r.OwnerMap)},
+		{"Tablespace map:", formatMapping(r.TablespaceMap)},
+	} {
+		if len(list.values) > 0 {
+			rows = append(rows, []string{list.label, strings.Join(list.values, ", ")})
+		}
+	}
+	if r.GrantTo != "" {
+		rows = append(rows, []string{"Grant to:", r.GrantTo})
+	}
+	if r.DumpTo != "" {
+		rows = append(rows, []string{"Upload to:", r.DumpTo})
+	}
+	if r.SearchPath != "" {
+		rows = append(rows, []string{"Search path:", r.SearchPath})
+	}
+	if r.UseList != "" {
+		rows = append(rows, []string{"Use list:", r.UseList})
+	}
+	if r.Timeout != "" {
+		rows = append(rows, []string{"Timeout:", r.Timeout})
+	}
+
+	log.Println("[info] Resolved options:")
+	for _, line := range formatTable(rows) {
+		log.Println("  " + line)
+	}
+}
+
+// describeConnection renders uri as user@host:port/database.
+func describeConnection(uri string) string {
+	if uri == "" {
+		return ""
+	}
+	conf, err := pgx.ParseConfig(uri)
+	if err != nil {
+		return redacted
+	}
+	return fmt.Sprintf("%s@%s/%s", conf.User, net.JoinHostPort(conf.Host, strconv.Itoa(int(conf.Port))), conf.Database)
+}
+
+// formatMapping renders each OLD=NEW pair of m, sorted by OLD.
+func formatMapping(m map[string]string) []string {
+	var pairs []string
+	for from, to := range m {
+		pairs = append(pairs, from+"="+to)
+	}
+	sort.Strings(pairs)
+	return pairs
+}
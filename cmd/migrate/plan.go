@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// printPlan logs what a migration with opts would do without executing it.
+func printPlan(ctx context.Context, d deps, opts migrationOpts) error {
+	if opts.restoreFrom == "" {
+		sourceSize, err := databaseSize(ctx, d.opener, opts.sourceURI)
+		if err != nil {
+			return fmt.Errorf("failed to query source size: %w", err)
+		}
+		log.Printf("[info] Source database size: %s", sourceSize)
+	}
+
+	targetSize, err := databaseSize(ctx, d.opener, opts.targetURI)
+	if err != nil {
+		return fmt.Errorf("failed to query target size: %w", err)
+	}
+	log.Printf("[info] Target database size: %s", targetSize)
+
+	if opts.restoreFrom != "" {
+		log.Printf("[info] %s would be restored into the target with psql or pg_restore, depending on its format", displaySource(opts.restoreFrom))
+		return nil
+	}
+
+	if opts.dumpTo != nil {
+		log.Printf("[info] The dump would be uploaded to %s", opts.dumpTo)
+	}
+
+	if opts.engine == enginePgx {
+		log.Println("[info] The selected tables would be created on the target and copied with COPY by the pgx engine")
+		return nil
+	}
+
+	log.Println("[info] The following commands would be run:")
+	if opts.noRestore {
+		log.Printf("  %s", formatCommand(opts.pgDumpPath, dumpArgs(opts)))
+		return nil
+	}
+	if opts.roles {
+		log.Printf("  %s | %s", formatCommand(opts.pgDumpallPath, []string{"--roles-only", "-d", opts.sourceURI}), formatCommand(opts.psqlPath, []string{"-d", opts.targetURI}))
+	}
+	if opts.format == formatPlain {
+		log.Printf("  %s | %s", formatCommand(opts.pgDumpPath, dumpArgs(opts)), formatCommand(opts.psqlPath, restoreArgs(opts)))
+		return nil
+	}
+
+	path := opts.dumpFile
+	if path == "" {
+		path = filepath.Join(opts.tempDir, "pg-import-*", "dump")
+	}
+	if _, err := os.Stat(path); opts.dumpFile != "" && err == nil {
+		log.Printf("  (dump skipped, %s already exists)", path)
+	} else {
+		log.Printf("  %s", formatCommand(opts.pgDumpPath, append(dumpArgs(opts), "-f", path)))
+	}
+	if len(opts.superuserObjects) > 0 {
+		opts.useList = filepath.Join(opts.tempDir, "pg-import-*.list")
+		log.Printf("  %s", formatCommand(opts.pgRestorePath, []string{"--list", path}))
+	}
+	if rewritesScript(opts) {
+		log.Printf("  %s | %s", formatCommand(opts.pgRestorePath, pgRestoreScriptArgs(opts, path)), formatCommand(opts.psqlPath, restoreArgs(opts)))
+		return nil
+	}
+	log.Printf("  %s", formatCommand(opts.pgRestorePath, pgRestoreArgs(opts, path)))
+
+	return nil
+}
+
+// databaseSize returns the human readable size of the database uri points at.
+func databaseSize(ctx context.Context, opener ConnOpener, uri string) (string, error) {
+	conn, err := opener.Open(ctx, uri)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = conn.Close(ctx) }()
+
+	var size string
+	err = conn.QueryRow(ctx, "SELECT pg_size_pretty(pg_database_size(current_database()))").Scan(&size)
+	return size, err
+}
@@ -0,0 +1,517 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ownedSequence is a sequence backing a serial or identity column.
+type ownedSequence struct {
+	sequence tableRef
+	table    tableRef
+	column   string
+}
+
+// sequenceCatalogMinVersion is the first server_version_num with
+// pg_sequence. Before it, a sequence's start value is read from the sequence
+// itself.
+const sequenceCatalogMinVersion = 100000
+
+// resetSequences advances each sequence owned by a migrated table past the
+// largest value in its column. A data-only import loads rows with explicit
+// ids, so without this the first insert on the target would collide with
+// existing rows.
+func resetSequences(ctx context.Context, d deps, opts migrationOpts) error {
+	uri, err := restoredTargetURI(opts)
+	if err != nil {
+		return err
+	}
+
+	conn, err := d.opener.Open(ctx, uri)
+	if err != nil {
+		return fmt.Errorf("failed to connect to target: %w", err)
+	}
+	defer func() { _ = conn.Close(ctx) }()
+
+	var version int
+	if err := conn.QueryRow(ctx, "SELECT current_setting('server_version_num')::int").Scan(&version); err != nil {
+		return fmt.Errorf("failed to query target version: %w", err)
+	}
+
+	rows, err := conn.Query(ctx, `SELECT sn.nspname, s.relname, tn.nspname, t.relname, a.attname
+		FROM pg_depend d
+		JOIN pg_class s ON s.oid = d.objid AND s.relkind = 'S'
+		JOIN pg_namespace sn ON sn.oid = s.relnamespace
+		JOIN pg_class t ON t.oid = d.refobjid
+		JOIN pg_namespace tn ON tn.oid = t.relnamespace
+		JOIN pg_attribute a ON a.attrelid = t.oid AND a.attnum = d.refobjsubid
+		WHERE d.classid = 'pg_class'::regclass
+		AND d.refclassid = 'pg_class'::regclass
+		AND d.deptype IN ('a', 'i')
+		ORDER BY 1, 2`)
+	if err != nil {
+		return fmt.Errorf("failed to query owned sequences: %w", err)
+	}
+
+	sequences, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (ownedSequence, error) {
+		var s ownedSequence
+		err := row.Scan(&s.sequence.schema, &s.sequence.name, &s.table.schema, &s.table.name, &s.column)
+		return s, err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to query owned sequences: %w", err)
+	}
+
+	filter := newTableFilter(opts)
+	for _, s := range sequences {
+		if !filter.includesTable(s.table) {
+			continue
+		}
+
+		sql := resetSequenceSQL(s, version)
+
+		var value int64
+		if err := conn.QueryRow(ctx, sql).Scan(&value); err != nil {
+			return fmt.Errorf("failed to reset sequence %s: %w", s.sequence, err)
+		}
+		log.Printf("[info] Reset sequence %s to %d", s.sequence, value)
+	}
+
+	return nil
+}
+
+// resetsSequences reports whether the restore leaves sequences behind the data
+// loaded, so resetSequences needs to run. The pgx engine creates serial
+// sequences afresh, so they need advancing too, unless no data was copied.
+func resetsSequences(opts migrationOpts) bool {
+	return opts.resetSequences && (opts.dataOnly || (opts.engine == enginePgx && !opts.schemaOnly))
+}
+
+// parallelMaintenance reports whether post-restore maintenance runs through
+// the client tools, such as vacuumdb, to work on tables concurrently. The
+// pgx engine doesn't need the client tools installed, so it always runs
+// maintenance over its own connection.
+func parallelMaintenance(opts migrationOpts) bool {
+	return opts.jobs > 1 && opts.engine != enginePgx
+}
+
+// resetSequenceSQL returns the statement that advances s past the largest
+// value in its column on a server of the given server_version_num. An empty
+// table resets the sequence to its start value, so the next value handed out
+// is the first one.
+func resetSequenceSQL(s ownedSequence, version int) string {
+	sequence := pgx.Identifier{s.sequence.schema, s.sequence.name}.Sanitize()
+	start := fmt.Sprintf("(SELECT seqstart FROM pg_catalog.pg_sequence WHERE seqrelid = %s::regclass)", quoteLiteral(sequence))
+	if version < sequenceCatalogMinVersion {
+		start = fmt.Sprintf("(SELECT start_value FROM %s)", sequence)
+	}
+	// The maximum is taken in a subquery, so a row is returned even when the
+	// table has none.
+	largest := fmt.Sprintf("(SELECT max(%s) FROM %s)", pgx.Identifier{s.column}.Sanitize(), pgx.Identifier{s.table.schema, s.table.name}.Sanitize())
+	return fmt.Sprintf("SELECT setval(%s::regclass, COALESCE(%s, %s), %s IS NOT NULL)", quoteLiteral(sequence), largest, start, largest)
+}
+
+// grantPrivileges grants opts.grantTo full access to the tables and sequences
+// in each migrated schema on the target, including those created later by the
+// target user. Grants are applied in a single transaction.
+func grantPrivileges(ctx context.Context, d deps, opts migrationOpts) error {
+	uri, err := restoredTargetURI(opts)
+	if err != nil {
+		return err
+	}
+
+	conn, err := d.opener.Open(ctx, uri)
+	if err != nil {
+		return fmt.Errorf("failed to connect to target: %w", err)
+	}
+	defer func() { _ = conn.Close(ctx) }()
+
+	rows, err := conn.Query(ctx, `SELECT nspname FROM pg_namespace
+		WHERE nspname NOT IN ('pg_catalog', 'information_schema')
+			AND nspname NOT LIKE 'pg\_%'
+		ORDER BY nspname`)
+	if err != nil {
+		return fmt.Errorf("failed to query target schemas: %w", err)
+	}
+	all, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return fmt.Errorf("failed to query target schemas: %w", err)
+	}
+
+	filter := newTableFilter(opts)
+	var schemas []string
+	for _, schema := range all {
+		if filter.includesSchema(schema) {
+			schemas = append(schemas, schema)
+		}
+	}
+
+	role := pgx.Identifier{opts.grantTo}.Sanitize()
+	err = pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+		for _, schema := range schemas {
+			name := pgx.Identifier{schema}.Sanitize()
+			for _, sql := range []string{
+				fmt.Sprintf("GRANT USAGE ON SCHEMA %s TO %s", name, role),
+				fmt.Sprintf("GRANT ALL ON ALL TABLES IN SCHEMA %s TO %s", name, role),
+				fmt.Sprintf("GRANT ALL ON ALL SEQUENCES IN SCHEMA %s TO %s", name, role),
+				fmt.Sprintf("ALTER DEFAULT PRIVILEGES IN SCHEMA %s GRANT ALL ON TABLES TO %s", name, role),
+				fmt.Sprintf("ALTER DEFAULT PRIVILEGES IN SCHEMA %s GRANT ALL ON SEQUENCES TO %s", name, role),
+			} {
+				if _, err := tx.Exec(ctx, sql); err != nil {
+					return fmt.Errorf("failed to grant privileges on schema %s: %w", schema, err)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("[info] Granted %s privileges on %d schema(s)", opts.grantTo, len(schemas))
+
+	return nil
+}
+
+// runPostRestore runs the steps that follow a successful restore: resetting
+// sequences, granting privileges, refreshing materialized views, analyzing
+// and verifying the target.
+func runPostRestore(ctx context.Context, d deps, opts migrationOpts, summary *migrationSummary) error {
+	// Post-restore steps have nothing to act on when the dump was only
+	// uploaded.
+	restored := !opts.noRestore
+
+	if restored && resetsSequences(opts) {
+		log.Println("[info] Resetting sequences...")
+		if err := resetSequences(ctx, d, opts); err != nil {
+			return err
+		}
+	}
+
+	if restored && opts.grantTo != "" {
+		log.Printf("[info] Granting privileges to %s...", opts.grantTo)
+		if err := grantPrivileges(ctx, d, opts); err != nil {
+			return err
+		}
+	}
+
+	// Views that fail to refresh are reported without failing the import, as
+	// they can be refreshed by hand once the cause is fixed.
+	if restored && opts.refreshMatviews {
+		log.Println("[info] Refreshing materialized views...")
+		if err := refreshMaterializedViews(ctx, d, opts); err != nil {
+			log.Printf("[warn] %s", err)
+		}
+	}
+
+	if restored && opts.reindex {
+		log.Println("[info] Reindexing target...")
+		if err := reindexTarget(ctx, d, opts); err != nil {
+			return err
+		}
+	}
+
+	// Vacuuming analyzes in the same pass, so the target is only scanned once.
+	switch {
+	case restored && opts.vacuum:
+		log.Println("[info] Vacuuming target...")
+		if err := vacuumTarget(ctx, d, opts); err != nil {
+			return err
+		}
+	case restored && opts.analyze:
+		log.Println("[info] Analyzing target...")
+		if err := analyzeTarget(ctx, d, opts); err != nil {
+			return err
+		}
+	}
+
+	// Imports that exclude the data section have no rows to compare, and
+	// restores of an existing dump have no source to compare against.
+	includesData := !opts.schemaOnly && (len(opts.sections) == 0 || contains(opts.sections, "data"))
+	if restored && !opts.skipVerify && includesData && opts.restoreFrom == "" {
+		setPhase(phaseVerify)
+		log.Println("[info] Verifying row counts...")
+		if err := verifyRowCounts(ctx, d, opts, summary); err != nil {
+			return err
+		}
+		log.Println("[info] Verification completed without issue")
+	}
+
+	if restored && opts.verifyChecksum && includesData && opts.restoreFrom == "" {
+		setPhase(phaseVerify)
+		log.Println("[info] Verifying checksums...")
+		if err := verifyChecksums(ctx, d, opts, summary); err != nil {
+			return err
+		}
+		log.Println("[info] Checksum verification completed without issue")
+	}
+
+	if restored && opts.verifySchema && opts.restoreFrom == "" {
+		setPhase(phaseVerify)
+		log.Println("[info] Verifying schema objects...")
+		if err := verifySchemaObjects(ctx, d, opts); err != nil {
+			return err
+		}
+		log.Println("[info] Schema verification completed without issue")
+	}
+
+	return nil
+}
+
+// matview is a materialized view on the target.
+type matview struct {
+	oid       uint32
+	view      tableRef
+	populated bool
+	// uniqueIndex is set when the view has an index REFRESH MATERIALIZED
+	// VIEW CONCURRENTLY can use to match rows.
+	uniqueIndex bool
+	dependsOn   []uint32
+}
+
+// refreshMaterializedViews refreshes each migrated materialized view on the target,
+// refreshing views before those defined on top of them. Populated views with
+// a suitable unique index are refreshed concurrently so they remain readable.
+// A view that fails to refresh is logged and skipped rather than aborting the
+// import, and the number of failures is returned in the error.
+func refreshMaterializedViews(ctx context.Context, d deps, opts migrationOpts) error {
+	uri, err := restoredTargetURI(opts)
+	if err != nil {
+		return err
+	}
+
+	conn, err := d.opener.Open(ctx, uri)
+	if err != nil {
+		return fmt.Errorf("failed to connect to target: %w", err)
+	}
+	defer func() { _ = conn.Close(ctx) }()
+
+	views, err := listMatviews(ctx, conn, newTableFilter(opts))
+	if err != nil {
+		return fmt.Errorf("failed to query materialized views: %w", err)
+	}
+
+	var failed int
+	for _, v := range sortMatviews(views) {
+		sql := "REFRESH MATERIALIZED VIEW "
+		if v.populated && v.uniqueIndex {
+			sql += "CONCURRENTLY "
+		}
+		sql += pgx.Identifier{v.view.schema, v.view.name}.Sanitize()
+
+		start := time.Now()
+		if _, err := conn.Exec(ctx, sql); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Printf("[warn] failed to refresh materialized view %s: %s", v.view, err)
+			failed++
+			continue
+		}
+		log.Printf("[info] Refreshed materialized view %s in %s", v.view, time.Since(start).Round(time.Millisecond))
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("failed to refresh %d of %d materialized view(s)", failed, len(views))
+	}
+	return nil
+}
+
+// listMatviews returns the materialized views on conn selected by filter,
+// along with the other materialized views each is defined on.
+func listMatviews(ctx context.Context, conn dbConn, filter tableFilter) ([]matview, error) {
+	rows, err := conn.Query(ctx, `SELECT c.oid, n.nspname, c.relname, c.relispopulated,
+			EXISTS (SELECT 1 FROM pg_index i WHERE i.indrelid = c.oid AND i.indisunique
+				AND i.indisvalid AND i.indpred IS NULL AND i.indexprs IS NULL),
+			ARRAY(SELECT DISTINCT dep.refobjid FROM pg_rewrite rw
+				JOIN pg_depend dep ON dep.classid = 'pg_rewrite'::regclass AND dep.objid = rw.oid
+				JOIN pg_class ref ON ref.oid = dep.refobjid AND ref.relkind = 'm'
+				WHERE rw.ev_class = c.oid AND dep.refobjid <> c.oid)
+		FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind = 'm'
+		ORDER BY n.nspname, c.relname`)
+	if err != nil {
+		return nil, err
+	}
+
+	all, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (matview, error) {
+		var v matview
+		err := row.Scan(&v.oid, &v.view.schema, &v.view.name, &v.populated, &v.uniqueIndex, &v.dependsOn)
+		return v, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var views []matview
+	for _, v := range all {
+		if filter.includesTable(v.view) {
+			views = append(views, v)
+		}
+	}
+	return views, nil
+}
+
+// sortMatviews orders views so each comes after the views it depends on,
+// otherwise preserving their order. Dependencies outside of views are
+// ignored.
+func sortMatviews(views []matview) []matview {
+	pending := map[uint32]bool{}
+	for _, v := range views {
+		pending[v.oid] = true
+	}
+
+	sorted := make([]matview, 0, len(views))
+	for len(sorted) < len(views) {
+		progressed := false
+		for _, v := range views {
+			if !pending[v.oid] || dependsOnPending(v, pending) {
+				continue
+			}
+			sorted = append(sorted, v)
+			delete(pending, v.oid)
+			progressed = true
+		}
+		// Postgres rejects cyclic view definitions, but don't loop forever
+		// if the catalog says otherwise.
+		if !progressed {
+			for _, v := range views {
+				if pending[v.oid] {
+					sorted = append(sorted, v)
+				}
+			}
+			break
+		}
+	}
+	return sorted
+}
+
+func dependsOnPending(v matview, pending map[uint32]bool) bool {
+	for _, oid := range v.dependsOn {
+		if pending[oid] {
+			return true
+		}
+	}
+	return false
+}
+
+// analyzeTarget collects planner statistics on the target, which a freshly
+// restored database lacks until autovacuum catches up. Parallel imports use
+// vacuumdb so tables are analyzed concurrently.
+func analyzeTarget(ctx context.Context, d deps, opts migrationOpts) error {
+	uri, err := restoredTargetURI(opts)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	if parallelMaintenance(opts) {
+		analyze := newStage(opts.vacuumdbPath, "--analyze-only", "--jobs="+strconv.Itoa(opts.jobs), "-d", uri)
+		if err := analyze.run(ctx, d.runner); err != nil {
+			return fmt.Errorf("failed to analyze target: %w", err)
+		}
+	} else {
+		conn, err := d.opener.Open(ctx, uri)
+		if err != nil {
+			return fmt.Errorf("failed to connect to target: %w", err)
+		}
+		defer func() { _ = conn.Close(ctx) }()
+
+		if _, err := conn.Exec(ctx, "ANALYZE"); err != nil {
+			return fmt.Errorf("failed to analyze target: %w", err)
+		}
+	}
+	log.Printf("[info] Analyze completed in %s", time.Since(start).Round(time.Millisecond))
+
+	return nil
+}
+
+// vacuumTarget freezes every table on the target, so autovacuum doesn't have
+// to rewrite the freshly loaded pages later, and analyzes them as well unless
+// --analyze=false. With --jobs, tables are vacuumed in parallel by vacuumdb.
+func vacuumTarget(ctx context.Context, d deps, opts migrationOpts) error {
+	uri, err := restoredTargetURI(opts)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	if parallelMaintenance(opts) {
+		args := []string{"--freeze", "--jobs=" + strconv.Itoa(opts.jobs), "-d", uri}
+		if opts.analyze {
+			args = append(args, "--analyze")
+		}
+		if err := newStage(opts.vacuumdbPath, args...).run(ctx, d.runner); err != nil {
+			return fmt.Errorf("failed to vacuum target: %w", err)
+		}
+	} else {
+		conn, err := d.opener.Open(ctx, uri)
+		if err != nil {
+			return fmt.Errorf("failed to connect to target: %w", err)
+		}
+		defer func() { _ = conn.Close(ctx) }()
+
+		tables, err := listTables(ctx, conn, tableFilter{})
+		if err != nil {
+			return fmt.Errorf("failed to list target tables: %w", err)
+		}
+
+		vacuum := "VACUUM (FREEZE) "
+		if opts.analyze {
+			vacuum = "VACUUM (FREEZE, ANALYZE) "
+		}
+		// Tables are vacuumed one at a time so progress can be reported.
+		for i, table := range tables {
+			if _, err := conn.Exec(ctx, vacuum+pgx.Identifier{table.schema, table.name}.Sanitize()); err != nil {
+				return fmt.Errorf("failed to vacuum %s: %w", table, err)
+			}
+			log.Printf("[info] Vacuumed %s (%d of %d)", table, i+1, len(tables))
+		}
+	}
+	log.Printf("[info] Vacuum completed in %s", time.Since(start).Round(time.Millisecond))
+
+	return nil
+}
+
+// reindexTarget rebuilds every index on the target, as after the collation
+// library changes version. With --jobs, tables are reindexed in parallel by
+// reindexdb.
+func reindexTarget(ctx context.Context, d deps, opts migrationOpts) error {
+	uri, err := restoredTargetURI(opts)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	if parallelMaintenance(opts) {
+		if err := newStage(opts.reindexdbPath, "--jobs="+strconv.Itoa(opts.jobs), "-d", uri).run(ctx, d.runner); err != nil {
+			return fmt.Errorf("failed to reindex target: %w", err)
+		}
+	} else {
+		conn, err := d.opener.Open(ctx, uri)
+		if err != nil {
+			return fmt.Errorf("failed to connect to target: %w", err)
+		}
+		defer func() { _ = conn.Close(ctx) }()
+
+		tables, err := listTables(ctx, conn, tableFilter{})
+		if err != nil {
+			return fmt.Errorf("failed to list target tables: %w", err)
+		}
+
+		// Tables are reindexed one at a time so progress can be reported.
+		for i, table := range tables {
+			if _, err := conn.Exec(ctx, "REINDEX TABLE "+pgx.Identifier{table.schema, table.name}.Sanitize()); err != nil {
+				return fmt.Errorf("failed to reindex %s: %w", table, err)
+			}
+			log.Printf("[info] Reindexed %s (%d of %d)", table, i+1, len(tables))
+		}
+	}
+	log.Printf("[info] Reindex completed in %s", time.Since(start).Round(time.Millisecond))
+
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func TestResetSequenceSQL(t *testing.T) {
+	s := ownedSequence{
+		sequence: tableRef{schema: "public", name: "users_id_seq"},
+		table:    tableRef{schema: "public", name: "users"},
+		column:   "id",
+	}
+
+	for _, tc := range []struct {
+		version int
+		want    string
+	}{
+		{160002, `SELECT setval('"public"."users_id_seq"'::regclass, ` +
+			`COALESCE((SELECT max("id") FROM "public"."users"), (SELECT seqstart FROM pg_catalog.pg_sequence WHERE seqrelid = '"public"."users_id_seq"'::regclass)), ` +
+			`(SELECT max("id") FROM "public"."users") IS NOT NULL)`},
+		{90624, `SELECT setval('"public"."users_id_seq"'::regclass, ` +
+			`COALESCE((SELECT max("id") FROM "public"."users"), (SELECT start_value FROM "public"."users_id_seq")), ` +
+			`(SELECT max("id") FROM "public"."users") IS NOT NULL)`},
+	} {
+		if got := resetSequenceSQL(s, tc.version); got != tc.want {
+			t.Errorf("resetSequenceSQL(%d) =\n%s\nexpected\n%s", tc.version, got, tc.want)
+		}
+	}
+}
+
+// TestResetSequences loads rows with explicit ids, as a data-only restore
+// does, and checks the next insert into each table doesn't conflict. It
+// needs a scratch database in PGIMPORT_TEST_DATABASE_URI.
+func TestResetSequences(t *testing.T) {
+	uri := os.Getenv("PGIMPORT_TEST_DATABASE_URI")
+	if uri == "" {
+		t.Skip("PGIMPORT_TEST_DATABASE_URI isn't set")
+	}
+
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, uri)
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err)
+	}
+	defer func() { _ = conn.Close(ctx) }()
+
+	const schema = "pgimport_reset_sequences_test"
+	setup := []string{
+		"DROP SCHEMA IF EXISTS " + schema + " CASCADE",
+		"CREATE SCHEMA " + schema,
+		"CREATE TABLE " + schema + ".loaded (id serial PRIMARY KEY)",
+		"INSERT INTO " + schema + ".loaded (id) VALUES (1), (2), (42)",
+		"CREATE TABLE " + schema + ".empty (id serial PRIMARY KEY)",
+		// The source's sequence had advanced past rows since deleted.
+		"SELECT setval('" + schema + ".empty_id_seq', 100)",
+		"CREATE TABLE " + schema + ".identity (id int GENERATED BY DEFAULT AS IDENTITY (START WITH 10) PRIMARY KEY)",
+		"INSERT INTO " + schema + ".identity (id) VALUES (10), (11)",
+	}
+	for _, sql := range setup {
+		if _, err := conn.Exec(ctx, sql); err != nil {
+			t.Fatalf("failed to run %s: %s", sql, err)
+		}
+	}
+	defer func() { _, _ = conn.Exec(ctx, "DROP SCHEMA "+schema+" CASCADE") }()
+
+	d := deps{opener: pgxOpener{opts: connectOpts{timeout: 10 * time.Second}}}
+	opts := migrationOpts{targetURI: uri, schemas: []string{schema}}
+	if err := resetSequences(ctx, d, opts); err != nil {
+		t.Fatalf("failed to reset sequences: %s", err)
+	}
+
+	for table, want := range map[string]int{"loaded": 43, "empty": 1, "identity": 12} {
+		var id int
+		if err := conn.QueryRow(ctx, "INSERT INTO "+schema+"."+table+" DEFAULT VALUES RETURNING id").Scan(&id); err != nil {
+			t.Errorf("failed to insert into %s after the reset: %s", table, err)
+			continue
+		}
+		if id != want {
+			t.Errorf("the next id in %s is %d, expected %d", table, id, want)
+		}
+	}
+}
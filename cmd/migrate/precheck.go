@@ -0,0 +1,1506 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// runPreChecks verifies the import can proceed. Client tool paths that weren't
+// set explicitly are resolved on opts once the server versions are known.
+// Checks against the source are skipped when restoring an existing dump.
+func runPreChecks(ctx context.Context, d deps, opts *migrationOpts, summary *migrationSummary) error {
+	if opts.waitForTarget > 0 {
+		if err := waitForTarget(ctx, d.opener, opts.targetURI, opts.waitForTarget); err != nil {
+			return err
+		}
+	}
+
+	if opts.precheckTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.precheckTimeout)
+		defer cancel()
+	}
+
+	var sourceConn dbConn
+	if opts.restoreFrom == "" {
+		conn, err := openSource(ctx, d, *opts)
+		if err != nil {
+			return err
+		}
+		sourceConn = conn
+		defer func() { _ = sourceConn.Close(ctx) }()
+	}
+
+	// Check target connectivity
+	targetConn, err := d.opener.Open(ctx, opts.targetURI)
+	if isUndefinedDatabase(err) && opts.create && sourceConn != nil {
+		// The database in the target URI is where the import belongs, so it's
+		// created up front and restored into directly.
+		targetConn, err = createTargetDatabase(ctx, d, *opts, sourceConn)
+		if err != nil {
+			return err
+		}
+		// Dry runs leave --create set, so later checks don't look for the
+		// database that wasn't created.
+		opts.create = opts.dryRun
+	}
+	if err != nil {
+		return classify(ErrTargetUnreachable, fmt.Errorf("failed to connect to target: %w", err))
+	}
+	defer func() { _ = targetConn.Close(ctx) }()
+
+	if opts.requireSSL {
+		if err := checkSSL(ctx, targetConn, "target"); err != nil {
+			return err
+		}
+		if sourceConn != nil {
+			if err := checkSSL(ctx, sourceConn, "source"); err != nil {
+				return err
+			}
+		}
+	}
+
+	var targetVersion string
+	if err := targetConn.QueryRow(ctx, "SHOW server_version;").Scan(&targetVersion); err != nil {
+		return fmt.Errorf("failed to query target version: %w", err)
+	}
+	log.Println("[info] Target Postgres version: " + targetVersion)
+	summary.TargetVersion = targetVersion
+
+	targetMajor, err := parseMajorVersion(targetVersion)
+	if err != nil {
+		return fmt.Errorf("could not parse target version: %w", err)
+	}
+
+	// Verify the target has a connection free for every restore job
+	if opts.jobs > 1 {
+		if err := limitJobs(ctx, targetConn, opts, targetMajor); err != nil {
+			return err
+		}
+	}
+
+	// Warn when the target is behind a pooler that doesn't keep sessions
+	if err := checkPooler(ctx, targetConn); err != nil {
+		return err
+	}
+
+	// Verify source version is not greater than the target
+	var sourceVersion string
+	var sourceMajor int
+	if sourceConn != nil {
+		if err := sourceConn.QueryRow(ctx, "SHOW server_version;").Scan(&sourceVersion); err != nil {
+			return fmt.Errorf("failed to query source version: %w", err)
+		}
+		log.Println("[info] Source Postgres version: " + sourceVersion)
+		summary.SourceVersion = sourceVersion
+
+		sourceMajor, err = parseMajorVersion(sourceVersion)
+		if err != nil {
+			return fmt.Errorf("could not parse source version: %w", err)
+		}
+
+		if sourceMajor > targetMajor {
+			return classify(ErrVersionIncompatible, fmt.Errorf("source is running a more recent major version than target. expected <= %s, got %s", targetVersion, sourceVersion))
+		}
+	}
+
+	// Verify the client tools are installed and recent enough for the source.
+	// Without one, the tools matching the target are preferred.
+	pgVersion := opts.pgVersion
+	if pgVersion == "" && sourceConn != nil {
+		pgVersion = formatMajorVersion(sourceMajor)
+	} else if pgVersion == "" {
+		pgVersion = formatMajorVersion(targetMajor)
+	}
+	resolveClientTools(opts, pgVersion)
+	if opts.engine != enginePgx {
+		if err := checkClientTools(ctx, d.runner, *opts, sourceVersion, sourceMajor); err != nil {
+			return err
+		}
+	}
+
+	if sourceConn != nil {
+		// Verify requested schemas exist on the source
+		if err := checkSchemasExist(ctx, sourceConn, opts.schemas); err != nil {
+			return err
+		}
+
+		// Warn about objects the source role can't read, as pg_dump would
+		// fail partway through on them
+		if err := checkSourcePrivileges(ctx, sourceConn, newTableFilter(*opts)); err != nil {
+			return err
+		}
+
+		// Report large objects, which pg_dump leaves out of filtered dumps
+		if err := checkLargeObjects(ctx, sourceConn, *opts); err != nil {
+			return err
+		}
+
+		// Suggest dumping from a replica when the source is a busy primary
+		if !opts.allowPrimary {
+			if err := checkWriteLoad(ctx, sourceConn); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Verify the target role can recreate the objects being restored
+	if opts.create || opts.clean {
+		if err := checkTargetPrivileges(ctx, targetConn, opts.create, newTableFilter(*opts)); err != nil {
+			return err
+		}
+	}
+
+	// Verify the import won't restore over existing tables, as happens when
+	// the source and target URIs are swapped
+	if !opts.force && createsSchema(*opts) {
+		if err := checkTargetEmpty(ctx, d, *opts, targetConn); err != nil {
+			return err
+		}
+	}
+
+	// Verify the roles objects are reassigned to exist on the target
+	var owners []string
+	for _, role := range opts.ownerMap {
+		owners = append(owners, role)
+	}
+	if err := checkRolesExist(ctx, targetConn, owners); err != nil {
+		return fmt.Errorf("--owner-map: %w", err)
+	}
+
+	// Verify the --grant-to role exists on the target
+	if opts.grantTo != "" {
+		if err := checkRolesExist(ctx, targetConn, []string{opts.grantTo}); err != nil {
+			return fmt.Errorf("--grant-to: %w", err)
+		}
+	}
+
+	// Verify the target role can disable triggers
+	if opts.disableTriggers {
+		var superuser bool
+		if err := targetConn.QueryRow(ctx, "SELECT rolsuper FROM pg_roles WHERE rolname = current_user").Scan(&superuser); err != nil {
+			return fmt.Errorf("failed to query target role: %w", err)
+		}
+		if !superuser {
+			return fmt.Errorf("--disable-triggers requires the target user %q to be a superuser", targetConn.Config().User)
+		}
+	}
+
+	// Warn about foreign keys no table order can satisfy in a data-only load
+	if opts.dataOnly && !opts.disableTriggers {
+		if err := checkCircularForeignKeys(ctx, targetConn, *opts); err != nil {
+			return err
+		}
+	}
+
+	// Warn about objects only a superuser can restore, as the target user
+	// on Fly usually isn't one
+	if err := checkSuperuserObjects(ctx, sourceConn, targetConn, opts, sourceMajor, targetMajor); err != nil {
+		return err
+	}
+
+	if sourceConn == nil {
+		return nil
+	}
+
+	// Verify the target database stores text the same way as the source. With
+	// --create it's created by the restore with the source's settings.
+	if !opts.create {
+		if err := checkEncoding(ctx, sourceConn, targetConn, opts.strict); err != nil {
+			return err
+		}
+	}
+
+	// Verify the collations text is sorted by are the same version on the
+	// target
+	if err := checkCollationVersions(ctx, sourceConn, targetConn, sourceMajor, targetMajor, opts.strict); err != nil {
+		return err
+	}
+
+	// Verify extensions used by the source can be installed on the target
+	if err := checkExtensions(ctx, sourceConn, targetConn, opts.ignoreMissingExtensions); err != nil {
+		return err
+	}
+
+	// Verify the target has room for the source data
+	if !opts.skipSpaceCheck {
+		if err := checkFreeSpace(ctx, sourceConn, targetConn, opts.minFreeBytes, opts.probeFreeSpace); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// createTargetDatabase creates the database named in the target URI with the
+// source's encoding and locale, and connects to it. Dry runs only report that
+// it would be created, and connect to the maintenance database instead.
+func createTargetDatabase(ctx context.Context, d deps, opts migrationOpts, sourceConn dbConn) (dbConn, error) {
+	targetConf, err := pgx.ParseConfig(opts.targetURI)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse target uri: %w", err)
+	}
+	database := targetConf.Database
+
+	maintenanceURI, err := withDatabase(opts.targetURI, "postgres")
+	if err != nil {
+		return nil, err
+	}
+	conn, err := d.opener.Open(ctx, maintenanceURI)
+	if err != nil {
+		return nil, classify(ErrTargetUnreachable, fmt.Errorf("failed to connect to target: %w", err))
+	}
+
+	if opts.dryRun {
+		log.Printf("[info] Target database %q doesn't exist and would be created", database)
+		return conn, nil
+	}
+	defer func() { _ = conn.Close(ctx) }()
+
+	source, err := queryEncoding(ctx, sourceConn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query source encoding: %w", err)
+	}
+
+	// template0 is the only template that can be copied with a different
+	// encoding or locale to its own.
+	sql := fmt.Sprintf("CREATE DATABASE %s TEMPLATE template0 ENCODING %s LC_COLLATE %s LC_CTYPE %s",
+		pgx.Identifier{database}.Sanitize(), quoteLiteral(source.encoding), quoteLiteral(source.collate), quoteLiteral(source.ctype))
+	if _, err := conn.Exec(ctx, sql); err != nil {
+		return nil, fmt.Errorf("failed to create target database %q: %w", database, err)
+	}
+	log.Printf("[info] Created target database %q (encoding %s, locale %s)", database, source.encoding, source.collate)
+
+	return d.opener.Open(ctx, opts.targetURI)
+}
+
+// openSource validates the source URI and connects to it.
+func openSource(ctx context.Context, d deps, opts migrationOpts) (dbConn, error) {
+	// Verify source URI specifies a database.
+	sourceConf, err := pgx.ParseConfig(opts.sourceURI)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse source uri: %w", err)
+	}
+	if sourceConf.Database == "" {
+		return nil, fmt.Errorf("source-uri must contain a database reference (e.g. postgres://<user>:<pass>@<host>:<port>/<database>)")
+	}
+
+	// Verify the import won't restore over the database being dumped
+	if !opts.allowSame {
+		restoredURI, err := restoredTargetURI(opts)
+		if err != nil {
+			return nil, err
+		}
+		targetConf, err := pgx.ParseConfig(restoredURI)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse target uri: %w", err)
+		}
+		same, err := sameDatabase(ctx, sourceConf, targetConf)
+		if err != nil {
+			return nil, err
+		}
+		if same {
+			return nil, fmt.Errorf("source and target refer to the same database (pass --allow-same to import anyway)")
+		}
+	}
+
+	// Catch the source and target being given the wrong way round before
+	// the import overwrites the database meant to be read from.
+	if !opts.allowSwapped {
+		if err := checkSwapped(sourceConf, opts.targetURI); err != nil {
+			return nil, err
+		}
+	}
+
+	// Verify the source is reachable from this machine before attempting to
+	// authenticate, so network issues aren't confused with credential issues.
+	// Through a tunnel the source is on loopback, and the forward was already
+	// checked when it was opened.
+	if !opts.sshTunnel {
+		if err := checkReachable(ctx, sourceConf.Host, sourceConf.Port); err != nil {
+			return nil, classify(ErrSourceUnreachable, err)
+		}
+	}
+
+	// Check source connectivity
+	sourceConn, err := d.opener.Open(ctx, opts.sourceURI)
+	if err != nil {
+		return nil, classify(ErrSourceUnreachable, fmt.Errorf("failed to connect to source: %w", err))
+	}
+	return sourceConn, nil
+}
+
+// waitForTarget polls the target until it answers a trivial query or the
+// timeout elapses.
+func waitForTarget(parentCtx context.Context, opener ConnOpener, uri string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(parentCtx, timeout)
+	defer cancel()
+
+	log.Printf("[info] Waiting up to %s for target to become ready...", timeout)
+
+	for attempt := 1; ; attempt++ {
+		err := pingDatabase(ctx, opener, uri)
+		if err == nil {
+			log.Println("[info] Target is ready")
+			return nil
+		}
+		log.Printf("[info] Target not ready (attempt %d): %s", attempt, err)
+
+		select {
+		case <-time.After(2 * time.Second):
+		case <-ctx.Done():
+			return classify(ErrTargetUnreachable, fmt.Errorf("target did not become ready within %s: %w", timeout, err))
+		}
+	}
+}
+
+func pingDatabase(ctx context.Context, opener ConnOpener, uri string) error {
+	conn, err := opener.Open(ctx, uri)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close(ctx) }()
+
+	_, err = conn.Exec(ctx, "SELECT 1")
+	return err
+}
+
+// clientToolsDir is where Debian based images install the client binaries for
+// each major version, e.g. /usr/lib/postgresql/14/bin.
+const clientToolsDir = "/usr/lib/postgresql"
+
+// resolveClientTools points each binary path that wasn't set explicitly at the
+// binary for the given major version when it's installed, falling back to
+// PATH otherwise.
+func resolveClientTools(opts *migrationOpts, version string) {
+	tools := []struct {
+		path *string
+		name string
+	}{
+		{&opts.pgDumpPath, "pg_dump"},
+		{&opts.psqlPath, "psql"},
+		{&opts.pgRestorePath, "pg_restore"},
+		{&opts.pgDumpallPath, "pg_dumpall"},
+		{&opts.vacuumdbPath, "vacuumdb"},
+		{&opts.reindexdbPath, "reindexdb"},
+	}
+
+	dir := filepath.Join(clientToolsDir, version, "bin")
+	found := false
+	for _, tool := range tools {
+		if *tool.path != "" {
+			continue
+		}
+		*tool.path = tool.name
+
+		candidate := filepath.Join(dir, tool.name)
+		if info, err := os.Stat(candidate); err == nil && info.Mode()&0111 != 0 {
+			*tool.path = candidate
+			found = true
+		}
+	}
+
+	if found {
+		log.Printf("[info] Using Postgres %s client tools from %s", version, dir)
+	} else if opts.pgVersion != "" {
+		log.Printf("[warn] No client tools found for Postgres %s in %s, falling back to PATH", version, dir)
+	}
+}
+
+// formatMajorVersion is the inverse of parseMajorVersion, returning the name
+// of a major version as used in installation paths (906 => 9.6, 1400 => 14).
+func formatMajorVersion(major int) string {
+	if major >= 1000 {
+		return strconv.Itoa(major / 100)
+	}
+	return fmt.Sprintf("%d.%d", major/100, major%100)
+}
+
+// checkClientTools verifies the binaries used for the import can be run and
+// logs their versions. pg_dump refuses to dump servers from a newer major
+// version, so that's caught here rather than partway through the dump.
+func checkClientTools(ctx context.Context, runner CommandRunner, opts migrationOpts, sourceVersion string, sourceMajor int) error {
+	var tools []string
+	switch {
+	case opts.restoreFrom != "":
+		// The dump's format isn't known until it's opened.
+		tools = append(tools, opts.psqlPath, opts.pgRestorePath)
+	case opts.format == formatPlain:
+		tools = append(tools, opts.pgDumpPath, opts.psqlPath)
+	case rewritesScript(opts):
+		tools = append(tools, opts.pgDumpPath, opts.pgRestorePath, opts.psqlPath)
+	default:
+		tools = append(tools, opts.pgDumpPath, opts.pgRestorePath)
+	}
+	if opts.roles {
+		tools = append(tools, opts.pgDumpallPath)
+		if !contains(tools, opts.psqlPath) {
+			tools = append(tools, opts.psqlPath)
+		}
+	}
+	// Checked now rather than failing once the restore has finished.
+	if parallelMaintenance(opts) && !opts.noRestore && (opts.analyze || opts.vacuum) {
+		tools = append(tools, opts.vacuumdbPath)
+	}
+	if parallelMaintenance(opts) && !opts.noRestore && opts.reindex {
+		tools = append(tools, opts.reindexdbPath)
+	}
+
+	for _, path := range tools {
+		version, err := clientVersion(ctx, runner, path)
+		if err != nil {
+			return fmt.Errorf("%s is required but could not be run: %w", path, err)
+		}
+		log.Printf("[info] Using %s", version)
+
+		if path != opts.pgDumpPath {
+			continue
+		}
+		// The version follows the product name, and may itself be followed
+		// by build details, as in "pg_dump (PostgreSQL) 16.1 (Homebrew)".
+		fields := strings.Fields(version)
+		if len(fields) < 3 || fields[1] != "(PostgreSQL)" {
+			return fmt.Errorf("unable to parse pg_dump version %q", version)
+		}
+		dumpVersion := fields[2]
+		major, err := parseMajorVersion(dumpVersion)
+		if err != nil {
+			return fmt.Errorf("unable to parse pg_dump version %q: %w", version, err)
+		}
+		if major < sourceMajor {
+			return classify(ErrVersionIncompatible, fmt.Errorf("client tools too old for source: pg_dump %s can't dump a %s server. install a newer pg_dump or pass --pg-dump-path", dumpVersion, sourceVersion))
+		}
+		if strings.HasPrefix(opts.compress, "zstd") && major < 1600 {
+			return classify(ErrVersionIncompatible, fmt.Errorf("--compress=%s requires pg_dump 16 or later, got %s", opts.compress, dumpVersion))
+		}
+	}
+
+	return nil
+}
+
+// clientVersion returns the output of running path with --version, e.g.
+// "pg_dump (PostgreSQL) 16.2".
+func clientVersion(ctx context.Context, runner CommandRunner, path string) (string, error) {
+	var out bytes.Buffer
+	s := newStage(path, "--version")
+	s.cmd.stdout = &out
+	if err := s.run(ctx, runner); err != nil {
+		return "", err
+	}
+
+	version := strings.TrimSpace(out.String())
+	if version == "" {
+		return "", fmt.Errorf("no version reported")
+	}
+	return version, nil
+}
+
+// sameDatabase reports whether a and b point at the same database on the same
+// server. Hosts are compared by their resolved addresses, so different names
+// for one server are still caught.
+func sameDatabase(ctx context.Context, a, b *pgx.ConnConfig) (bool, error) {
+	if a.Port != b.Port || a.Database != b.Database {
+		return false, nil
+	}
+	if a.Host == b.Host {
+		return true, nil
+	}
+
+	aAddrs, err := resolveHost(ctx, a.Host)
+	if err != nil {
+		return false, err
+	}
+	bAddrs, err := resolveHost(ctx, b.Host)
+	if err != nil {
+		return false, err
+	}
+
+	for _, addr := range aAddrs {
+		if contains(bAddrs, addr) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// resolveHost returns the addresses host resolves to. Unix socket paths are
+// returned as is.
+func resolveHost(ctx context.Context, host string) ([]string, error) {
+	if isSocketHost(host) {
+		return []string{host}, nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", host, err)
+	}
+	return addrs, nil
+}
+
+// foreignKey is a foreign key constraint from one table to another.
+type foreignKey struct {
+	name       string
+	table      tableRef
+	references tableRef
+	deferrable bool
+}
+
+// checkCircularForeignKeys warns when the tables being loaded on the target
+// reference each other in a cycle, as rows can't then be loaded table by
+// table without violating a foreign key, unless the checks are deferred to
+// the end of the load or disabled.
+func checkCircularForeignKeys(ctx context.Context, conn dbConn, opts migrationOpts) error {
+	// A table referencing itself is fine, as COPY checks its rows once the
+	// whole table is loaded.
+	rows, err := conn.Query(ctx, `SELECT con.conname, cn.nspname, c.relname, fn.nspname, f.relname, con.condeferrable
+		FROM pg_constraint con
+		JOIN pg_class c ON c.oid = con.conrelid
+		JOIN pg_namespace cn ON cn.oid = c.relnamespace
+		JOIN pg_class f ON f.oid = con.confrelid
+		JOIN pg_namespace fn ON fn.oid = f.relnamespace
+		WHERE con.contype = 'f' AND con.conrelid <> con.confrelid
+		ORDER BY 2, 3, 1`)
+	if err != nil {
+		return fmt.Errorf("failed to query target foreign keys: %w", err)
+	}
+	keys, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (foreignKey, error) {
+		var k foreignKey
+		err := row.Scan(&k.name, &k.table.schema, &k.table.name, &k.references.schema, &k.references.name, &k.deferrable)
+		return k, err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to query target foreign keys: %w", err)
+	}
+
+	filter := newTableFilter(opts)
+	var loaded []foreignKey
+	for _, k := range keys {
+		if filter.includesTable(k.table) && filter.includesTable(k.references) {
+			loaded = append(loaded, k)
+		}
+	}
+
+	for _, cycle := range foreignKeyCycles(loaded) {
+		var tables, immediate []string
+		for _, k := range cycle {
+			if !contains(tables, k.table.String()) {
+				tables = append(tables, k.table.String())
+			}
+			if !k.deferrable {
+				immediate = append(immediate, k.name+" on "+k.table.String())
+			}
+		}
+
+		switch {
+		case !opts.deferConstraints:
+			log.Printf("[warn] tables %s reference each other through foreign keys, so no load order satisfies them. pass --defer-constraints if the constraints are deferrable, otherwise --disable-triggers (requires a superuser)", abbreviateList(tables))
+		case len(immediate) > 0:
+			log.Printf("[warn] tables %s reference each other through foreign keys that aren't deferrable (%s), which --defer-constraints can't defer. make them DEFERRABLE, or pass --disable-triggers instead (requires a superuser)", abbreviateList(tables), abbreviateList(immediate))
+		}
+	}
+
+	return nil
+}
+
+// foreignKeyCycles returns the foreign keys of each group of tables that
+// reference each other in a cycle, found as the strongly connected components
+// of the reference graph.
+func foreignKeyCycles(keys []foreignKey) [][]foreignKey {
+	edges := map[tableRef][]tableRef{}
+	var nodes []tableRef
+	addNode := func(t tableRef) {
+		if _, ok := edges[t]; !ok {
+			edges[t] = nil
+			nodes = append(nodes, t)
+		}
+	}
+	for _, k := range keys {
+		addNode(k.table)
+		addNode(k.references)
+		edges[k.table] = append(edges[k.table], k.references)
+	}
+
+	// Tarjan's algorithm.
+	index := map[tableRef]int{}
+	low := map[tableRef]int{}
+	onStack := map[tableRef]bool{}
+	var stack []tableRef
+	component := map[tableRef]int{}
+	components := 0
+
+	var visit func(t tableRef)
+	visit = func(t tableRef) {
+		index[t] = len(index)
+		low[t] = index[t]
+		stack = append(stack, t)
+		onStack[t] = true
+
+		for _, next := range edges[t] {
+			if _, seen := index[next]; !seen {
+				visit(next)
+				if low[next] < low[t] {
+					low[t] = low[next]
+				}
+			} else if onStack[next] && index[next] < low[t] {
+				low[t] = index[next]
+			}
+		}
+
+		if low[t] == index[t] {
+			for {
+				top := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				onStack[top] = false
+				component[top] = components
+				if top == t {
+					break
+				}
+			}
+			components++
+		}
+	}
+	for _, t := range nodes {
+		if _, seen := index[t]; !seen {
+			visit(t)
+		}
+	}
+
+	// Only keys within a single component form part of a cycle, as
+	// self-references were excluded.
+	byComponent := map[int][]foreignKey{}
+	var order []int
+	for _, k := range keys {
+		c := component[k.table]
+		if c != component[k.references] {
+			continue
+		}
+		if byComponent[c] == nil {
+			order = append(order, c)
+		}
+		byComponent[c] = append(byComponent[c], k)
+	}
+
+	var cycles [][]foreignKey
+	for _, c := range order {
+		cycles = append(cycles, byComponent[c])
+	}
+	return cycles
+}
+
+// checkSwapped returns an error when the source looks like a Fly Postgres
+// app and the target like a database outside Fly, which is the opposite of a
+// typical import.
+func checkSwapped(source *pgx.ConnConfig, targetURI string) error {
+	target, err := pgx.ParseConfig(targetURI)
+	if err != nil {
+		return fmt.Errorf("failed to parse target uri: %w", err)
+	}
+
+	// Only the host is telling, as external databases are commonly
+	// connected to as postgres too. A target reached through a socket is
+	// co-located with the import, as on a Fly machine.
+	if !isFlyHost(source.Host) || isFlyHost(target.Host) || isSocketHost(target.Host) {
+		return nil
+	}
+
+	return fmt.Errorf("the source (%s) looks like a Fly Postgres app and the target (%s) like an external database, so SOURCE_DATABASE_URI and TARGET_DATABASE_URI may be swapped. check the resolved options above, and pass --allow-swapped if this is intended",
+		source.Host, target.Host)
+}
+
+// isFlyHost reports whether host is on Fly's private network, either by
+// name or by a 6PN address.
+func isFlyHost(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if strings.HasSuffix(host, ".internal") || strings.HasSuffix(host, ".flycast") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.To4() == nil && ip[0] == 0xfd && ip[1] == 0xaa
+}
+
+// limitJobs lowers opts.jobs to the number of connections the target has
+// free, so the restore isn't refused connections partway through. pg_restore
+// opens one connection per job besides its own, as does the pgx engine, and
+// connections reserved for superusers aren't counted.
+func limitJobs(ctx context.Context, conn dbConn, opts *migrationOpts, major int) error {
+	// Connections for roles with pg_use_reserved_connections were added in
+	// Postgres 16, and backend types in 10.
+	reserved := "current_setting('superuser_reserved_connections')::int"
+	if major >= 1600 {
+		reserved += " + current_setting('reserved_connections')::int"
+	}
+	clients := "true"
+	if major >= 1000 {
+		clients = "backend_type = 'client backend'"
+	}
+
+	var limit, used int
+	if err := conn.QueryRow(ctx, `SELECT current_setting('max_connections')::int - (`+reserved+`),
+		(SELECT count(*) FROM pg_stat_activity WHERE `+clients+`)::int`).Scan(&limit, &used); err != nil {
+		return fmt.Errorf("failed to query target connection limit: %w", err)
+	}
+
+	// The pre-check connection is closed before the restore starts.
+	free := limit - used + 1
+	// One connection is left for the restore's own.
+	jobs := free - 1
+	if jobs < 1 {
+		return fmt.Errorf("the target has no connections free for the restore: %d of %d in use", used, limit)
+	}
+	if opts.jobs > jobs {
+		log.Printf("[warn] Lowering --jobs from %d to %d, as the target has %d of %d connections free", opts.jobs, jobs, free, limit)
+		opts.jobs = jobs
+	}
+	log.Printf("[info] Restoring with %d jobs", opts.jobs)
+	return nil
+}
+
+// poolerProbes is the number of transactions checkPooler runs.
+const poolerProbes = 5
+
+// checkPooler warns when the target appears to be behind a pooler such as
+// PgBouncer in transaction or statement pooling mode. Each transaction may
+// then run on a different server connection, which is detected by the
+// backend changing between them.
+func checkPooler(ctx context.Context, conn dbConn) error {
+	pids := map[int32]bool{}
+	pooled := false
+	for i := 0; i < poolerProbes && !pooled; i++ {
+		var pid int32
+		err := conn.QueryRow(ctx, "SELECT pg_backend_pid()").Scan(&pid)
+		if isPreparedStatementError(err) {
+			pooled = true
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to query target backend: %w", err)
+		}
+		pids[pid] = true
+		pooled = len(pids) > 1
+	}
+	if !pooled {
+		return nil
+	}
+
+	log.Println("[warn] The target appears to be behind a connection pooler such as PgBouncer in transaction pooling mode, as consecutive transactions ran on different server connections. " +
+		"restores rely on a single session, so session settings, including those passed through PGOPTIONS for --statement-timeout, may be lost or rejected. " +
+		"point TARGET_DATABASE_URI at the database itself rather than the pooler")
+	return nil
+}
+
+// isSocketHost reports whether host names the directory of a Unix socket, as
+// with host=/var/run/postgresql, rather than a network host.
+func isSocketHost(host string) bool {
+	return strings.HasPrefix(host, "/")
+}
+
+// socketPath returns the path of the socket Postgres listens on for port in
+// the directory dir.
+func socketPath(dir string, port uint16) string {
+	return filepath.Join(dir, ".s.PGSQL."+strconv.Itoa(int(port)))
+}
+
+// checkReachable verifies a TCP connection can be established to host:port.
+// Loopback hosts are rejected outright, as the import runs on an ephemeral
+// machine that can't see a proxy running on the operator's workstation.
+func checkReachable(ctx context.Context, host string, port uint16) error {
+	// A co-located source may be connected to through its Unix socket
+	// directory instead, in which case the socket only needs to exist.
+	if isSocketHost(host) {
+		path := socketPath(host, port)
+		if _, err := os.Stat(path); err != nil {
+			return fmt.Errorf("cannot reach source socket %s: %w", path, err)
+		}
+		return nil
+	}
+
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("failed to resolve source host %q: %w", host, err)
+	}
+
+	for _, ip := range ips {
+		if ip.IP.IsLoopback() {
+			return fmt.Errorf("source host %q resolves to a loopback address. the source must be reachable from the import machine, so a local proxy (e.g. fly proxy) won't work", host)
+		}
+	}
+
+	addr := net.JoinHostPort(host, strconv.Itoa(int(port)))
+
+	dialer := net.Dialer{Timeout: 5 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("cannot reach %s: %w", addr, err)
+	}
+
+	return conn.Close()
+}
+
+// parseMajorVersion converts a server_version string into a comparable major
+// version number. Releases prior to 10 use a three-part scheme where the major
+// version spans the first two components (9.6.24 => 906), while 10 and later
+// use a two-part scheme where only the first component matters (14.2 => 1400).
+func parseMajorVersion(version string) (int, error) {
+	// Distributions commonly append build details, e.g. "14.2 (Debian 14.2-1)".
+	fields := strings.Fields(version)
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("empty version string")
+	}
+
+	parts := strings.Split(fields[0], ".")
+
+	major, err := strconv.Atoi(leadingDigits(parts[0]))
+	if err != nil {
+		return 0, fmt.Errorf("invalid version %q", version)
+	}
+
+	if major >= 10 {
+		return major * 100, nil
+	}
+
+	if len(parts) < 2 {
+		return 0, fmt.Errorf("invalid version %q", version)
+	}
+
+	minor, err := strconv.Atoi(leadingDigits(parts[1]))
+	if err != nil {
+		return 0, fmt.Errorf("invalid version %q", version)
+	}
+
+	return major*100 + minor, nil
+}
+
+// leadingDigits returns the numeric prefix of s so pre-release versions like
+// "16beta1" or "17devel" resolve to their major version.
+func leadingDigits(s string) string {
+	for i, r := range s {
+		if r < '0' || r > '9' {
+			return s[:i]
+		}
+	}
+	return s
+}
+
+// checkSchemasExist verifies each literal schema name exists on the source.
+// Patterns are skipped, as pg_dump resolves those itself.
+func checkSchemasExist(ctx context.Context, conn dbConn, schemas []string) error {
+	var names []string
+	for _, schema := range schemas {
+		if !strings.ContainsAny(schema, "*?") {
+			names = append(names, schema)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	rows, err := conn.Query(ctx, "SELECT nspname FROM pg_namespace WHERE nspname = ANY($1)", names)
+	if err != nil {
+		return fmt.Errorf("failed to query source schemas: %w", err)
+	}
+
+	found, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return fmt.Errorf("failed to query source schemas: %w", err)
+	}
+
+	var missing []string
+	for _, name := range names {
+		if !contains(found, name) {
+			missing = append(missing, name)
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("schemas not found on source: %s", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// maxListedObjects limits how many objects are named in a single warning.
+const maxListedObjects = 20
+
+// checkSourcePrivileges warns about dumped schemas the source role lacks USAGE
+// on, and dumped relations it can't SELECT from.
+func checkSourcePrivileges(ctx context.Context, conn dbConn, filter tableFilter) error {
+	rows, err := conn.Query(ctx, `SELECT n.nspname, c.relname,
+			has_schema_privilege(n.oid, 'USAGE'),
+			has_table_privilege(c.oid, 'SELECT')
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind IN ('r', 'p', 'v', 'm', 'S', 'f')
+			AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+			AND n.nspname NOT LIKE 'pg\_toast%'
+			AND n.nspname NOT LIKE 'pg\_temp\_%'
+		ORDER BY n.nspname, c.relname`)
+	if err != nil {
+		return fmt.Errorf("failed to query source privileges: %w", err)
+	}
+
+	var schemas, tables []string
+	var t tableRef
+	var schemaUsage, tableSelect bool
+	_, err = pgx.ForEachRow(rows, []any{&t.schema, &t.name, &schemaUsage, &tableSelect}, func() error {
+		if !filter.includesTable(t) {
+			return nil
+		}
+		switch {
+		case !schemaUsage:
+			if !contains(schemas, t.schema) {
+				schemas = append(schemas, t.schema)
+			}
+		case !tableSelect:
+			tables = append(tables, t.String())
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to query source privileges: %w", err)
+	}
+
+	user := conn.Config().User
+	if len(schemas) > 0 {
+		log.Printf("[warn] Source user %q lacks USAGE on %d schema(s): %s", user, len(schemas), abbreviateList(schemas))
+	}
+	if len(tables) > 0 {
+		log.Printf("[warn] Source user %q can't SELECT from %d table(s): %s", user, len(tables), abbreviateList(tables))
+	}
+	if len(schemas) > 0 || len(tables) > 0 {
+		log.Println("[warn] pg_dump will fail when it reaches these objects. Grant access or exclude them with --exclude-schema/--exclude-table")
+	}
+
+	return nil
+}
+
+// checkTargetPrivileges verifies the target role holds the privileges needed
+// to recreate objects. With create, that's the CREATEDB attribute, as the
+// restore creates the database itself. Otherwise it's CREATE on the target
+// database and on each dumped schema that already exists there.
+func checkTargetPrivileges(ctx context.Context, conn dbConn, create bool, filter tableFilter) error {
+	user := conn.Config().User
+
+	var superuser, createDB bool
+	if err := conn.QueryRow(ctx, "SELECT rolsuper, rolcreatedb FROM pg_roles WHERE rolname = current_user").Scan(&superuser, &createDB); err != nil {
+		return fmt.Errorf("failed to query target role: %w", err)
+	}
+	if superuser {
+		return nil
+	}
+
+	if create {
+		if !createDB {
+			return fmt.Errorf("--create requires the target user %q to have the CREATEDB privilege", user)
+		}
+		return nil
+	}
+
+	var database string
+	var databaseCreate bool
+	if err := conn.QueryRow(ctx, "SELECT current_database(), has_database_privilege(current_database(), 'CREATE')").Scan(&database, &databaseCreate); err != nil {
+		return fmt.Errorf("failed to query target privileges: %w", err)
+	}
+	if !databaseCreate {
+		return fmt.Errorf("target user %q lacks the CREATE privilege on database %q", user, database)
+	}
+
+	rows, err := conn.Query(ctx, `SELECT nspname FROM pg_namespace
+		WHERE NOT has_schema_privilege(oid, 'CREATE')
+			AND nspname NOT IN ('pg_catalog', 'information_schema')
+			AND nspname NOT LIKE 'pg\_%'
+		ORDER BY nspname`)
+	if err != nil {
+		return fmt.Errorf("failed to query target privileges: %w", err)
+	}
+	denied, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return fmt.Errorf("failed to query target privileges: %w", err)
+	}
+
+	var missing []string
+	for _, schema := range denied {
+		if filter.includesSchema(schema) {
+			missing = append(missing, schema)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("target user %q lacks the CREATE privilege on schema(s): %s", user, abbreviateList(missing))
+	}
+
+	return nil
+}
+
+// createsSchema reports whether the import recreates tables on the target,
+// rather than loading data into ones that already exist.
+func createsSchema(opts migrationOpts) bool {
+	return !opts.dataOnly && (len(opts.sections) == 0 || contains(opts.sections, "pre-data"))
+}
+
+// checkTargetEmpty verifies the database being restored into has none of the
+// tables selected for import. With --create that's the database named after
+// the source, which is empty when it doesn't exist yet.
+func checkTargetEmpty(ctx context.Context, d deps, opts migrationOpts, conn dbConn) error {
+	if opts.create {
+		uri, err := restoredTargetURI(opts)
+		if err != nil {
+			return err
+		}
+		restoredConn, err := d.opener.Open(ctx, uri)
+		if isUndefinedDatabase(err) {
+			return nil
+		}
+		if err != nil {
+			return classify(ErrTargetUnreachable, fmt.Errorf("failed to connect to target: %w", err))
+		}
+		defer func() { _ = restoredConn.Close(ctx) }()
+		conn = restoredConn
+	}
+
+	// Tables belonging to extensions are recreated along with them, so don't
+	// count as user data.
+	rows, err := conn.Query(ctx, `SELECT n.nspname, c.relname
+		FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind IN ('r', 'p', 'm', 'f')
+		AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+		AND n.nspname NOT LIKE 'pg_toast%'
+		AND NOT EXISTS (
+			SELECT 1 FROM pg_depend dep
+			WHERE dep.classid = 'pg_class'::regclass AND dep.objid = c.oid AND dep.deptype = 'e'
+		)
+		ORDER BY n.nspname, c.relname`)
+	if err != nil {
+		return fmt.Errorf("failed to query target tables: %w", err)
+	}
+	all, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (tableRef, error) {
+		var t tableRef
+		err := row.Scan(&t.schema, &t.name)
+		return t, err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to query target tables: %w", err)
+	}
+
+	filter := newTableFilter(opts)
+	var existing []string
+	for _, t := range all {
+		if filter.includesTable(t) {
+			existing = append(existing, t.String())
+		}
+	}
+	if len(existing) > 0 {
+		return classify(ErrTargetNotEmpty, fmt.Errorf("target already contains %d table(s): %s. re-run with --force to import into it anyway", len(existing), abbreviateList(existing)))
+	}
+
+	return nil
+}
+
+// checkRolesExist verifies each of roles exists on the target.
+func checkRolesExist(ctx context.Context, conn dbConn, roles []string) error {
+	if len(roles) == 0 {
+		return nil
+	}
+
+	rows, err := conn.Query(ctx, "SELECT rolname FROM pg_roles WHERE rolname = ANY($1)", roles)
+	if err != nil {
+		return fmt.Errorf("failed to query target roles: %w", err)
+	}
+	found, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return fmt.Errorf("failed to query target roles: %w", err)
+	}
+
+	var missing []string
+	for _, role := range roles {
+		if !contains(found, role) && !contains(missing, role) {
+			missing = append(missing, role)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("roles not found on target: %s", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+const (
+	// writeLoadInterval is how long source write activity is sampled for.
+	writeLoadInterval = 2 * time.Second
+	// writeLoadThreshold is the rate of row changes, per second, above which
+	// a primary is considered to be under write load.
+	writeLoadThreshold = 100
+)
+
+// checkWriteLoad warns when the source is a primary with significant write
+// traffic, as the dump adds read load on top of it and holds locks that block
+// schema changes until it completes. It's advisory only.
+func checkWriteLoad(ctx context.Context, conn dbConn) error {
+	var inRecovery bool
+	if err := conn.QueryRow(ctx, "SELECT pg_is_in_recovery()").Scan(&inRecovery); err != nil {
+		return fmt.Errorf("failed to query source recovery status: %w", err)
+	}
+	if inRecovery {
+		log.Println("[info] Source is a replica")
+		return nil
+	}
+
+	before, err := rowChanges(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-time.After(writeLoadInterval):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	after, err := rowChanges(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	rate := float64(after-before) / writeLoadInterval.Seconds()
+	if rate < writeLoadThreshold {
+		log.Printf("[info] Source is a primary with light write activity (%.0f row changes/s)", rate)
+		return nil
+	}
+
+	log.Printf("[warn] Source is a primary under write load (%.0f row changes/s). Consider importing from a replica to avoid impacting production traffic, or pass --allow-primary to acknowledge", rate)
+	return nil
+}
+
+// rowChanges returns the cumulative number of rows inserted, updated and
+// deleted in the current database.
+func rowChanges(ctx context.Context, conn dbConn) (int64, error) {
+	var changes int64
+	// Statistics are cached for the length of a transaction, which each
+	// sample runs outside of.
+	err := conn.QueryRow(ctx, `SELECT tup_inserted + tup_updated + tup_deleted
+		FROM pg_stat_database WHERE datname = current_database()`).Scan(&changes)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query source activity: %w", err)
+	}
+	return changes, nil
+}
+
+// databaseEncoding is how a database encodes and sorts text.
+type databaseEncoding struct {
+	encoding string
+	collate  string
+	ctype    string
+}
+
+func queryEncoding(ctx context.Context, conn dbConn) (databaseEncoding, error) {
+	var e databaseEncoding
+	err := conn.QueryRow(ctx, `SELECT pg_encoding_to_char(encoding), datcollate, datctype
+		FROM pg_database WHERE datname = current_database()`).Scan(&e.encoding, &e.collate, &e.ctype)
+	return e, err
+}
+
+// checkEncoding warns when the source and target databases differ in encoding
+// or locale. Text that can't be represented in the target encoding fails to
+// restore, and a different collation changes sort order and can invalidate
+// indexes on text columns. Under strict, a mismatch is an error instead.
+func checkEncoding(ctx context.Context, sourceConn, targetConn dbConn, strict bool) error {
+	source, err := queryEncoding(ctx, sourceConn)
+	if err != nil {
+		return fmt.Errorf("failed to query source encoding: %w", err)
+	}
+	target, err := queryEncoding(ctx, targetConn)
+	if err != nil {
+		return fmt.Errorf("failed to query target encoding: %w", err)
+	}
+
+	var mismatches []string
+	if source.encoding != target.encoding {
+		mismatches = append(mismatches, fmt.Sprintf("encoding %s on source, %s on target", source.encoding, target.encoding))
+	}
+	if source.collate != target.collate {
+		mismatches = append(mismatches, fmt.Sprintf("LC_COLLATE %s on source, %s on target", source.collate, target.collate))
+	}
+	if source.ctype != target.ctype {
+		mismatches = append(mismatches, fmt.Sprintf("LC_CTYPE %s on source, %s on target", source.ctype, target.ctype))
+	}
+	if len(mismatches) == 0 {
+		return nil
+	}
+
+	msg := "source and target databases differ: " + strings.Join(mismatches, "; ")
+	if strict {
+		return fmt.Errorf("%s. re-run without --strict to import anyway", msg)
+	}
+	log.Printf("[warn] %s. Text may fail to restore or sort differently on the target", msg)
+	return nil
+}
+
+// checkCollationVersions compares the versions the source and target report
+// for the database's default collation and those used by indexes on the
+// source. A different version of glibc or ICU may sort text differently, so
+// unique and ordered indexes built on one can be wrong on the other. Versions
+// are only reported from Postgres 10, and for the default collation from 15.
+func checkCollationVersions(ctx context.Context, sourceConn, targetConn dbConn, sourceMajor, targetMajor int, strict bool) error {
+	if sourceMajor < 1000 || targetMajor < 1000 {
+		return nil
+	}
+
+	rows, err := sourceConn.Query(ctx, `SELECT DISTINCT c.collname
+		FROM pg_index i
+		CROSS JOIN LATERAL unnest(i.indcollation::oid[]) AS coll(oid)
+		JOIN pg_collation c ON c.oid = coll.oid
+		JOIN pg_class t ON t.oid = i.indrelid
+		JOIN pg_namespace n ON n.oid = t.relnamespace
+		WHERE c.collname <> 'default'
+			AND n.nspname NOT IN ('pg_catalog', 'information_schema') AND n.nspname NOT LIKE 'pg_toast%'
+		ORDER BY 1`)
+	if err != nil {
+		return fmt.Errorf("failed to query source collations: %w", err)
+	}
+	names, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return fmt.Errorf("failed to query source collations: %w", err)
+	}
+
+	source, err := collationVersions(ctx, sourceConn, sourceMajor, names)
+	if err != nil {
+		return fmt.Errorf("failed to query source collation versions: %w", err)
+	}
+	target, err := collationVersions(ctx, targetConn, targetMajor, names)
+	if err != nil {
+		return fmt.Errorf("failed to query target collation versions: %w", err)
+	}
+
+	var mismatches []string
+	for _, name := range append([]string{"default"}, names...) {
+		s, t := source[name], target[name]
+		if s != "" && t != "" && s != t {
+			mismatches = append(mismatches, fmt.Sprintf("%s version %s on source, %s on target", name, s, t))
+		}
+	}
+	if len(mismatches) == 0 {
+		return nil
+	}
+
+	msg := "collation versions differ between source and target: " + abbreviateList(mismatches)
+	if strict {
+		return fmt.Errorf("%s. re-run without --strict to import anyway", msg)
+	}
+	log.Printf("[warn] %s. Text may sort differently on the target, so pass --reindex to rebuild its indexes after the import", msg)
+	return nil
+}
+
+// collationVersions returns the version conn's collation library reports for
+// each of the named collations, and for the database's default collation as
+// "default". Collations without a version, such as C, are left out.
+func collationVersions(ctx context.Context, conn dbConn, major int, names []string) (map[string]string, error) {
+	versions := map[string]string{}
+	if major >= 1500 {
+		var version *string
+		if err := conn.QueryRow(ctx, `SELECT pg_database_collation_actual_version(oid)
+			FROM pg_database WHERE datname = current_database()`).Scan(&version); err != nil {
+			return nil, err
+		}
+		if version != nil {
+			versions["default"] = *version
+		}
+	}
+	if len(names) == 0 {
+		return versions, nil
+	}
+
+	rows, err := conn.Query(ctx, `SELECT collname, pg_collation_actual_version(oid) FROM pg_collation
+		WHERE collname = ANY($1)
+			AND collencoding IN (-1, (SELECT encoding FROM pg_database WHERE datname = current_database()))`, names)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var version *string
+		if err := rows.Scan(&name, &version); err != nil {
+			return nil, err
+		}
+		if version != nil {
+			versions[name] = *version
+		}
+	}
+	return versions, rows.Err()
+}
+
+// abbreviateList joins names with commas, truncating long lists.
+func abbreviateList(names []string) string {
+	if len(names) <= maxListedObjects {
+		return strings.Join(names, ", ")
+	}
+	return fmt.Sprintf("%s and %d more", strings.Join(names[:maxListedObjects], ", "), len(names)-maxListedObjects)
+}
+
+// checkExtensions verifies every extension installed on the source is
+// available on the target, so the restore doesn't fail midway through on a
+// CREATE EXTENSION statement.
+func checkExtensions(ctx context.Context, sourceConn, targetConn dbConn, ignoreMissing bool) error {
+	rows, err := sourceConn.Query(ctx, "SELECT extname FROM pg_extension WHERE extname <> 'plpgsql' ORDER BY extname")
+	if err != nil {
+		return fmt.Errorf("failed to query source extensions: %w", err)
+	}
+	installed, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return fmt.Errorf("failed to query source extensions: %w", err)
+	}
+	if len(installed) == 0 {
+		return nil
+	}
+
+	rows, err = targetConn.Query(ctx, "SELECT name FROM pg_available_extensions")
+	if err != nil {
+		return fmt.Errorf("failed to query target extensions: %w", err)
+	}
+	available, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return fmt.Errorf("failed to query target extensions: %w", err)
+	}
+
+	log.Println("[info] The following extensions will be created on the target:")
+	var missing []string
+	for _, ext := range installed {
+		log.Printf("  CREATE EXTENSION IF NOT EXISTS %s;", pgx.Identifier{ext}.Sanitize())
+		if !contains(available, ext) {
+			missing = append(missing, ext)
+		}
+	}
+
+	if len(missing) == 0 {
+		return nil
+	}
+
+	if ignoreMissing {
+		log.Printf("[warn] Extensions used by the source are not available on the target: %s", strings.Join(missing, ", "))
+		return nil
+	}
+
+	return fmt.Errorf("extensions used by the source are not available on the target: %s. re-run with --ignore-missing-extensions to continue anyway", strings.Join(missing, ", "))
+}
+
+// checkLargeObjects reports whether large objects on the source will be
+// imported. pg_dump includes them by default unless --schema, --table or
+// --schema-only is given, which is easily missed, so they're logged up front.
+func checkLargeObjects(ctx context.Context, conn dbConn, opts migrationOpts) error {
+	// pg_largeobject itself is only readable by superusers, unlike its
+	// metadata and size.
+	var count, size int64
+	if err := conn.QueryRow(ctx, `SELECT (SELECT count(*) FROM pg_largeobject_metadata),
+		pg_total_relation_size('pg_catalog.pg_largeobject')`).Scan(&count, &size); err != nil {
+		return fmt.Errorf("failed to query source large objects: %w", err)
+	}
+	if count == 0 {
+		return nil
+	}
+
+	found := fmt.Sprintf("%d large objects (%s)", count, formatBytes(size))
+	switch {
+	case opts.engine == enginePgx:
+		log.Printf("[warn] The source has %s, which --engine=pgx doesn't copy. use --engine=pg_dump to import them", found)
+	case opts.noBlobs:
+		log.Printf("[info] The source has %s, which won't be imported (--no-blobs)", found)
+	case opts.blobs:
+		log.Printf("[info] The source has %s, which will be imported (--blobs)", found)
+	case len(opts.schemas) > 0 || len(opts.tables) > 0 || opts.schemaOnly:
+		log.Printf("[warn] The source has %s, which pg_dump leaves out with --schema, --table or --schema-only. pass --blobs to import them", found)
+	default:
+		log.Printf("[info] The source has %s, which will be imported and may make the dump much larger. pass --no-blobs to leave them out", found)
+	}
+	return nil
+}
+
+// checkFreeSpace compares the size of the source database against the free
+// space available to the target's data directory. Free space can only be
+// determined by running a program on the target server, so it's only
+// measured with --probe-free-space, and when the target role may run server
+// programs. Otherwise the source size is logged and the check is skipped.
+func checkFreeSpace(ctx context.Context, sourceConn, targetConn dbConn, required int64, probe bool) error {
+	var sourceSize int64
+	if err := sourceConn.QueryRow(ctx, "SELECT pg_database_size(current_database())").Scan(&sourceSize); err != nil {
+		return fmt.Errorf("failed to query source size: %w", err)
+	}
+	if required == 0 {
+		required = sourceSize
+	}
+
+	if !probe {
+		log.Printf("[info] Source database size: %d bytes. pass --probe-free-space to compare it against the target's free space", sourceSize)
+		return nil
+	}
+
+	available, err := targetFreeSpace(ctx, targetConn)
+	if err != nil {
+		log.Printf("[warn] Unable to determine free space on target (%s). The source database is %d bytes", err, sourceSize)
+		return nil
+	}
+	log.Printf("[info] Source database size: %d bytes, target free space: %d bytes", sourceSize, available)
+
+	if available < required {
+		return fmt.Errorf("target has %d bytes free but at least %d are required. re-run with --skip-space-check or --min-free-bytes to override", available, required)
+	}
+
+	return nil
+}
+
+// targetFreeSpace returns the number of bytes available on the volume holding
+// the target's data directory.
+func targetFreeSpace(ctx context.Context, conn dbConn) (int64, error) {
+	var dataDir string
+	if err := conn.QueryRow(ctx, "SHOW data_directory").Scan(&dataDir); err != nil {
+		return 0, err
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	program := "df -Pk '" + strings.ReplaceAll(dataDir, "'", `'\''`) + "'"
+	if _, err := tx.Exec(ctx, "CREATE TEMP TABLE pg_import_df (line text) ON COMMIT DROP"); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(ctx, "COPY pg_import_df FROM PROGRAM "+quoteLiteral(program)); err != nil {
+		return 0, err
+	}
+
+	rows, err := tx.Query(ctx, "SELECT line FROM pg_import_df")
+	if err != nil {
+		return 0, err
+	}
+	lines, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return 0, err
+	}
+
+	// Filesystem 1024-blocks Used Available Capacity Mounted on
+	if len(lines) < 2 {
+		return 0, fmt.Errorf("unexpected df output")
+	}
+	fields := strings.Fields(lines[1])
+	if len(fields) < 4 {
+		return 0, fmt.Errorf("unexpected df output: %q", lines[1])
+	}
+
+	kb, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected df output: %q", lines[1])
+	}
+
+	return kb * 1024, nil
+}
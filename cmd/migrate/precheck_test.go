@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func TestIPv6SourceHost(t *testing.T) {
+	const uri = "postgres://user:pass@[fdaa:0:1:a7b::3]:5432/db"
+
+	conf, err := pgx.ParseConfig(uri)
+	if err != nil {
+		t.Fatalf("failed to parse %s: %s", uri, err)
+	}
+	if conf.Host != "fdaa:0:1:a7b::3" || conf.Port != 5432 {
+		t.Fatalf("parsed host %q and port %d", conf.Host, conf.Port)
+	}
+	if !isFlyHost(conf.Host) {
+		t.Errorf("%s isn't recognized as a Fly address", conf.Host)
+	}
+
+	tunneled, err := withHostPort(uri, "::1", 15432)
+	if err != nil {
+		t.Fatalf("failed to rewrite %s: %s", uri, err)
+	}
+	if conf, err := pgx.ParseConfig(tunneled); err != nil {
+		t.Errorf("failed to parse rewritten %s: %s", tunneled, err)
+	} else if conf.Host != "::1" || conf.Port != 15432 {
+		t.Errorf("rewritten uri %s has host %q and port %d", tunneled, conf.Host, conf.Port)
+	}
+
+	err = checkReachable(context.Background(), "::1", 5432)
+	if err == nil || !strings.Contains(err.Error(), "loopback") {
+		t.Errorf("expected ::1 to be rejected as a loopback address, got %v", err)
+	}
+
+	// The address doesn't need to answer, only to be dialed as an IPv6
+	// literal rather than failing to resolve.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = checkReachable(ctx, conf.Host, conf.Port)
+	if err == nil {
+		t.Skipf("%s is reachable from here", conf.Host)
+	}
+	if !strings.Contains(err.Error(), "cannot reach [fdaa:0:1:a7b::3]:5432") {
+		t.Errorf("expected a dial failure, got %s", err)
+	}
+}
+
+func TestSocketSourceHost(t *testing.T) {
+	for _, uri := range []string{
+		"host=/var/run/postgresql user=app dbname=app",
+		"postgres:///app?host=/var/run/postgresql&user=app",
+	} {
+		conf, err := pgx.ParseConfig(uri)
+		if err != nil {
+			t.Fatalf("failed to parse %s: %s", uri, err)
+		}
+		if conf.Host != "/var/run/postgresql" {
+			t.Errorf("%s parsed to host %q", uri, conf.Host)
+		}
+		if !isSocketHost(conf.Host) {
+			t.Errorf("%s isn't recognized as a socket directory", conf.Host)
+		}
+		if got := socketPath(conf.Host, conf.Port); got != "/var/run/postgresql/.s.PGSQL.5432" {
+			t.Errorf("socketPath(%q, %d) = %s", conf.Host, conf.Port, got)
+		}
+	}
+
+	dir := t.TempDir()
+	if addrs, err := resolveHost(context.Background(), dir); err != nil || len(addrs) != 1 || addrs[0] != dir {
+		t.Errorf("resolveHost(%q) = %v, %v", dir, addrs, err)
+	}
+
+	err := checkReachable(context.Background(), dir, 5432)
+	if err == nil || !strings.Contains(err.Error(), "cannot reach source socket") {
+		t.Errorf("expected a missing socket to be reported, got %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, ".s.PGSQL.5432"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkReachable(context.Background(), dir, 5432); err != nil {
+		t.Errorf("expected the socket to be reachable, got %s", err)
+	}
+}
+
+// preCheckFixture is a socket-connected source, so nothing is dialed, and a
+// target whose connections are faked.
+func preCheckFixture(t *testing.T, sourceVersion, targetVersion, dumpVersion string) (deps, migrationOpts) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, ".s.PGSQL.5432"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	sourceURI := "host=" + dir + " user=app dbname=app"
+	targetURI := "postgres://app@127.0.0.1:5432/app"
+
+	common := []fakeResult{
+		{query: "SHOW server_version"},
+		{query: "SELECT pg_backend_pid()", rows: [][]any{{int32(1234)}}},
+		{query: "SELECT rolsuper FROM pg_roles", rows: [][]any{{true}}},
+		{query: "pg_database_collation_actual_version", rows: [][]any{{"2.36"}}},
+		{query: "pg_encoding_to_char", rows: [][]any{{"UTF8", "en_US.UTF-8", "en_US.UTF-8"}}},
+	}
+	source := newFakeConn(t, sourceURI, append([]fakeResult{
+		{query: "SHOW server_version", rows: [][]any{{sourceVersion}}},
+		{query: "pg_database_size", rows: [][]any{{int64(1 << 20)}}},
+		{query: "pg_largeobject_metadata", rows: [][]any{{int64(0), int64(0)}}},
+		// A replica, so the write load isn't sampled.
+		{query: "pg_is_in_recovery()", rows: [][]any{{true}}},
+	}, common...)...)
+	target := newFakeConn(t, targetURI, append([]fakeResult{
+		{query: "SHOW server_version", rows: [][]any{{targetVersion}}},
+	}, common...)...)
+
+	runner := &fakeRunner{handlers: map[string]func(context.Context, command) error{
+		"pg_dump": printVersion("pg_dump (PostgreSQL) " + dumpVersion),
+		"psql":    printVersion("psql (PostgreSQL) " + dumpVersion),
+	}}
+	d := deps{runner: runner, opener: fakeOpener{sourceURI: source, targetURI: target}}
+
+	return d, migrationOpts{
+		sourceURI: sourceURI,
+		targetURI: targetURI,
+		format:    formatPlain,
+		jobs:      1,
+	}
+}
+
+func TestRunPreChecks(t *testing.T) {
+	d, opts := preCheckFixture(t, "15.4", "16.2", "16.2")
+
+	var summary migrationSummary
+	if err := runPreChecks(context.Background(), d, &opts, &summary); err != nil {
+		t.Fatalf("pre-checks failed: %s", err)
+	}
+	if summary.SourceVersion != "15.4" || summary.TargetVersion != "16.2" {
+		t.Errorf("summary has source %q and target %q", summary.SourceVersion, summary.TargetVersion)
+	}
+	if filepath.Base(opts.pgDumpPath) != "pg_dump" || filepath.Base(opts.psqlPath) != "psql" {
+		t.Errorf("client tools resolved to %s and %s", opts.pgDumpPath, opts.psqlPath)
+	}
+}
+
+func TestRunPreChecksRejectsIncompatibleVersions(t *testing.T) {
+	for _, tc := range []struct {
+		name                        string
+		source, target, dumpVersion string
+		detail                      string
+	}{
+		{"source newer than target", "16.2", "15.4", "16.2", "more recent major version than target"},
+		{"pg_dump older than source", "16.2", "16.2", "15.4", "client tools too old for source"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d, opts := preCheckFixture(t, tc.source, tc.target, tc.dumpVersion)
+
+			err := runPreChecks(context.Background(), d, &opts, &migrationSummary{})
+			if !errors.Is(err, ErrVersionIncompatible) {
+				t.Fatalf("expected a version incompatibility, got %v", err)
+			}
+			if !strings.Contains(err.Error(), tc.detail) {
+				t.Errorf("expected the error to include %q, got %s", tc.detail, err)
+			}
+		})
+	}
+}
+
+func TestParseMajorVersion(t *testing.T) {
+	for _, tc := range []struct {
+		version string
+		want    int
+		wantErr bool
+	}{
+		{version: "9.6.24", want: 906},
+		{version: "14.2", want: 1400},
+		{version: "16.2 (Debian 16.2-1.pgdg120+1)", want: 1600},
+		{version: "17devel", want: 1700},
+		{version: "", wantErr: true},
+		{version: "abc", wantErr: true},
+	} {
+		got, err := parseMajorVersion(tc.version)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("parseMajorVersion(%q) = %d, expected an error", tc.version, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("parseMajorVersion(%q) = %d, %v, expected %d", tc.version, got, err, tc.want)
+		}
+	}
+}
+
+func TestRunPreChecksComparesMajorVersions(t *testing.T) {
+	for _, tc := range []struct {
+		source, target string
+		accepted       bool
+	}{
+		{"9.6.24", "14.2", true},
+		{"14.2", "13.9", false},
+		{"10.23", "10.23", true},
+	} {
+		t.Run(tc.source+" to "+tc.target, func(t *testing.T) {
+			// pg_dump matches the target, so only the servers are compared.
+			d, opts := preCheckFixture(t, tc.source, tc.target, tc.target)
+
+			err := runPreChecks(context.Background(), d, &opts, &migrationSummary{})
+			if tc.accepted && err != nil {
+				t.Errorf("expected the import to be accepted, got %s", err)
+			}
+			if !tc.accepted && !errors.Is(err, ErrVersionIncompatible) {
+				t.Errorf("expected a version incompatibility, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCheckClientToolsParsesPgDumpVersion(t *testing.T) {
+	for _, tc := range []struct {
+		version string
+		// tooOld is whether pg_dump is older than a 16.2 source.
+		tooOld  bool
+		wantErr string
+	}{
+		{version: "pg_dump (PostgreSQL) 16.2"},
+		{version: "pg_dump (PostgreSQL) 16.1 (Homebrew)"},
+		{version: "pg_dump (PostgreSQL) 15.2 (Debian 15.2-1.pgdg110+1)", tooOld: true},
+		{version: "pg_dump (PostgreSQL) 15.5 (Homebrew)", tooOld: true},
+		{version: "pg_dump (PostgreSQL) 17devel"},
+		{version: "pg_dump (PostgreSQL) unknown", wantErr: "unable to parse pg_dump version"},
+		{version: "pg_dump 16.2", wantErr: "unable to parse pg_dump version"},
+	} {
+		t.Run(tc.version, func(t *testing.T) {
+			runner := &fakeRunner{handlers: map[string]func(context.Context, command) error{
+				"pg_dump": printVersion(tc.version),
+				"psql":    printVersion("psql (PostgreSQL) 16.2"),
+			}}
+			opts := migrationOpts{format: formatPlain, pgDumpPath: "pg_dump", psqlPath: "psql"}
+
+			err := checkClientTools(context.Background(), runner, opts, "16.2", 1600)
+			switch {
+			case tc.wantErr != "":
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("expected an error including %q, got %v", tc.wantErr, err)
+				}
+			case tc.tooOld:
+				if !errors.Is(err, ErrVersionIncompatible) {
+					t.Errorf("expected pg_dump to be too old, got %v", err)
+				} else if strings.Contains(err.Error(), "Homebrew") || strings.Contains(err.Error(), "pgdg") {
+					t.Errorf("expected only the version number in the error, got %s", err)
+				}
+			case err != nil:
+				t.Errorf("expected pg_dump to be accepted, got %s", err)
+			}
+		})
+	}
+}
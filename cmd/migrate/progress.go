@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// progressInterval is how often dump progress is logged.
+const progressInterval = 10 * time.Second
+
+// estimateDumpSize approximates how many bytes the dump will produce from the
+// on-disk size of the selected tables, excluding their indexes, which are
+// dumped as definitions only. It returns 0 when the dump's size can't be
+// predicted, as compressed archives are far smaller than the data within them.
+func estimateDumpSize(ctx context.Context, d deps, opts migrationOpts) int64 {
+	if opts.format != formatPlain && opts.compress != "0" {
+		return 0
+	}
+	if opts.schemaOnly {
+		return 0
+	}
+
+	conn, err := d.opener.Open(ctx, opts.sourceURI)
+	if err != nil {
+		log.Printf("[warn] failed to estimate dump size: %s", err)
+		return 0
+	}
+	defer func() { _ = conn.Close(ctx) }()
+
+	rows, err := conn.Query(ctx, `SELECT n.nspname, c.relname, pg_table_size(c.oid)
+		FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind IN ('r', 'm')
+		AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+		AND n.nspname NOT LIKE 'pg_toast%'`)
+	if err != nil {
+		log.Printf("[warn] failed to estimate dump size: %s", err)
+		return 0
+	}
+	defer rows.Close()
+
+	filter := newTableFilter(opts)
+	var total int64
+	for rows.Next() {
+		var t tableRef
+		var size int64
+		if err := rows.Scan(&t.schema, &t.name, &size); err != nil {
+			log.Printf("[warn] failed to estimate dump size: %s", err)
+			return 0
+		}
+		if filter.includesTable(t) {
+			total += size
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("[warn] failed to estimate dump size: %s", err)
+		return 0
+	}
+
+	return total
+}
+
+// startProgress logs the number of bytes count reports every progressInterval
+// until the returned function is called, along with the rate over the last
+// interval. Given an estimated total, the percentage complete and time
+// remaining are logged too.
+func startProgress(total int64, count func() int64) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	start := time.Now()
+
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+
+		var last int64
+		lastTick := start
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				n := count()
+				rate := float64(n-last) / now.Sub(lastTick).Seconds()
+				last, lastTick = n, now
+				logProgress(n, total, rate, now.Sub(start))
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// startHeartbeat logs the time elapsed since start, and the phase the import
+// is in, every interval until the returned function is called. Unlike the
+// progress logs it needs nothing from the phase, so even those that are
+// otherwise silent for minutes show they're still running.
+func startHeartbeat(interval time.Duration, start time.Time) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				log.Printf("[info] Still running (phase %s), elapsed %s", currentPhase(), time.Since(start).Round(time.Second))
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+func logProgress(n, total int64, rate float64, elapsed time.Duration) {
+	if total <= 0 {
+		log.Printf("[info] Dump progress: %s written, %s/s", formatBytes(n), formatBytes(int64(rate)))
+		return
+	}
+
+	// The total is an estimate, so the dump may overrun it. Progress is held
+	// below 100% until the dump actually completes.
+	percent := n * 100 / total
+	if percent > 99 {
+		percent = 99
+	}
+
+	eta := "unknown"
+	if n > 0 && n < total {
+		remaining := time.Duration(float64(elapsed) * float64(total-n) / float64(n))
+		eta = remaining.Round(time.Second).String()
+	}
+
+	log.Printf("[info] Dump progress: %d%% (%s of ~%s), %s/s, ETA %s", percent, formatBytes(n), formatBytes(total), formatBytes(int64(rate)), eta)
+}
+
+// copyProgressMinVersion is the first server_version_num with
+// pg_stat_progress_copy.
+const copyProgressMinVersion = 140000
+
+// startCopyMonitor polls pg_stat_progress_copy on the target over a separate
+// connection until the returned function is called, logging the tables being
+// loaded. It's a no-op without --progress, and gives up with a warning if the
+// view can't be read.
+func startCopyMonitor(ctx context.Context, d deps, opts migrationOpts) (stop func()) {
+	if !opts.progress {
+		return func() {}
+	}
+
+	conn, err := d.opener.Open(ctx, opts.targetURI)
+	if err != nil {
+		log.Printf("[warn] failed to connect to target to monitor progress: %s", err)
+		return func() {}
+	}
+
+	var version int
+	if err := conn.QueryRow(ctx, "SELECT current_setting('server_version_num')::int").Scan(&version); err != nil || version < copyProgressMinVersion {
+		log.Println("[warn] --progress requires Postgres 14 or later on the target, skipping per-table progress")
+		_ = conn.Close(ctx)
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		defer func() { _ = conn.Close(context.Background()) }()
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := logCopyProgress(ctx, conn); err != nil {
+					if ctx.Err() == nil {
+						log.Printf("[warn] failed to query pg_stat_progress_copy, skipping per-table progress: %s", err)
+					}
+					return
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// logCopyProgress logs each COPY into the target's database in flight.
+func logCopyProgress(ctx context.Context, conn dbConn) error {
+	rows, err := conn.Query(ctx, `SELECT relid::regclass::text, tuples_processed, bytes_processed, bytes_total
+		FROM pg_stat_progress_copy
+		WHERE datname = current_database() AND command = 'COPY FROM'
+		ORDER BY relid::regclass::text`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var table string
+		var tuples, bytes, total int64
+		if err := rows.Scan(&table, &tuples, &bytes, &total); err != nil {
+			return err
+		}
+		// bytes_total is only known when copying from a file, whereas the
+		// restore streams rows over the connection.
+		if total > 0 {
+			log.Printf("[info] Loading %s: %d rows, %s of %s", table, tuples, formatBytes(bytes), formatBytes(total))
+		} else {
+			log.Printf("[info] Loading %s: %d rows, %s", table, tuples, formatBytes(bytes))
+		}
+	}
+
+	return rows.Err()
+}
+
+// formatBytes renders n using the binary units --max-rate accepts.
+func formatBytes(n int64) string {
+	const unit = 1 << 10
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	value, suffix := float64(n), ""
+	for _, s := range []string{"KiB", "MiB", "GiB", "TiB"} {
+		value /= unit
+		suffix = s
+		if value < unit {
+			break
+		}
+	}
+	return fmt.Sprintf("%.1f %s", value, suffix)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// rateLimiter caps the combined rate data is written through the writers it
+// limits, so concurrent copies share one budget.
+type rateLimiter struct {
+	rate int64
+
+	mu      sync.Mutex
+	start   time.Time
+	written int64
+}
+
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	return &rateLimiter{rate: bytesPerSecond}
+}
+
+// limit returns a writer whose writes to w count against the limit. A nil
+// limiter leaves w unlimited.
+func (l *rateLimiter) limit(w io.Writer) io.Writer {
+	if l == nil {
+		return w
+	}
+	return &rateLimitedWriter{w: w, limiter: l}
+}
+
+// wait records n bytes as written and sleeps until the elapsed time catches
+// up with everything written so far.
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+	if l.start.IsZero() {
+		l.start = time.Now()
+	}
+	l.written += int64(n)
+	due := l.start.Add(time.Duration(float64(l.written) / float64(l.rate) * float64(time.Second)))
+	l.mu.Unlock()
+
+	if wait := time.Until(due); wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// rateLimitedWriter caps the rate data is written through it. As pg_dump's
+// output flows through a pipe, blocking here slows the dump itself, and with
+// it the load placed on the source.
+type rateLimitedWriter struct {
+	w       io.Writer
+	limiter *rateLimiter
+}
+
+func newRateLimitedWriter(w io.Writer, bytesPerSecond int64) *rateLimitedWriter {
+	return &rateLimitedWriter{w: w, limiter: newRateLimiter(bytesPerSecond)}
+}
+
+func (l *rateLimitedWriter) Write(p []byte) (int, error) {
+	// Writes are split into chunks of a tenth of a second's worth of data,
+	// so large writes are smoothed out rather than sent in bursts.
+	chunk := int(l.limiter.rate / 10)
+	if chunk < 1 {
+		chunk = 1
+	}
+
+	total := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > chunk {
+			n = chunk
+		}
+
+		written, err := l.w.Write(p[:n])
+		total += written
+		if err != nil {
+			return total, err
+		}
+		l.limiter.wait(written)
+		p = p[n:]
+	}
+
+	return total, nil
+}
+
+// throttle limits writes to w to --max-rate, if one was set.
+func throttle(opts migrationOpts, w io.Writer) io.Writer {
+	if opts.maxRate <= 0 {
+		return w
+	}
+	return newRateLimitedWriter(w, opts.maxRate)
+}
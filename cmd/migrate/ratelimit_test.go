@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterIsSharedByWriters(t *testing.T) {
+	const (
+		rate    = 100 << 10
+		writers = 4
+		each    = 10 << 10
+	)
+	limiter := newRateLimiter(rate)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := limiter.limit(io.Discard).Write(make([]byte, each)); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Each writer alone would finish in a tenth of a second, but together
+	// they're held to the one rate.
+	want := time.Duration(float64(writers*each) / rate * float64(time.Second))
+	if elapsed := time.Since(start); elapsed < want*3/4 {
+		t.Errorf("%d writers wrote %d bytes in %s, expected at least %s at %d bytes/s", writers, writers*each, elapsed, want, rate)
+	}
+}
+
+func TestNilRateLimiterDoesNotLimit(t *testing.T) {
+	var limiter *rateLimiter
+	if w := limiter.limit(io.Discard); w != io.Discard {
+		t.Errorf("a nil limiter wrapped the writer in %T", w)
+	}
+}
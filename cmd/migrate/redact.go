@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const redacted = "****"
+
+// passwordKeywordRe matches the password in a keyword/value connection string.
+var passwordKeywordRe = regexp.MustCompile(`(password\s*=\s*)('(?:[^'\\]|\\.)*'|\S+)`)
+
+// redactURI masks the password in a connection string so it can be safely
+// logged. Both URL and keyword/value forms are supported.
+func redactURI(uri string) string {
+	if !strings.HasPrefix(uri, "postgres://") && !strings.HasPrefix(uri, "postgresql://") {
+		return passwordKeywordRe.ReplaceAllString(uri, "${1}"+redacted)
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		// Don't risk echoing back something we couldn't make sense of.
+		return redacted
+	}
+
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redacted)
+	}
+
+	query := u.Query()
+	if query.Has("password") {
+		query.Set("password", redacted)
+		u.RawQuery = query.Encode()
+	}
+
+	// net/url escapes the asterisks of the mask, so restore them for legibility.
+	return strings.ReplaceAll(u.String(), strings.Repeat("%2A", len(redacted)), redacted)
+}
+
+// formatCommand renders a command line for display, redacting credentials and
+// quoting arguments that contain whitespace or shell metacharacters.
+func formatCommand(name string, args []string) string {
+	parts := []string{name}
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "postgres://") || strings.HasPrefix(arg, "postgresql://") || strings.Contains(arg, "password") {
+			arg = redactURI(arg)
+		}
+		if strings.ContainsAny(arg, " \t\n'\"\\$`;&|<>()*?!#~") {
+			arg = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		}
+		parts = append(parts, arg)
+	}
+	return strings.Join(parts, " ")
+}
+
+// rawPasswordRe captures the password of a URL connection string exactly as
+// written, before any percent-decoding.
+var rawPasswordRe = regexp.MustCompile(`^postgres(?:ql)?://[^:@/]*:([^@/]*)@`)
+
+// minSecretLength is the shortest password masked wherever it appears in log
+// output. Shorter values would mangle unrelated text, and are still masked
+// as part of any connection string that contains them.
+const minSecretLength = 4
+
+// redactingWriter masks known connection strings and passwords in everything
+// written through it. It sits in front of the log output so neither messages
+// nor the command output they relay can leak credentials.
+type redactingWriter struct {
+	mu       sync.Mutex
+	out      io.Writer
+	replacer *strings.Replacer
+	pairs    []string
+}
+
+func newRedactingWriter(out io.Writer) *redactingWriter {
+	return &redactingWriter{out: out, replacer: strings.NewReplacer()}
+}
+
+// addURI registers the credentials within uri for redaction.
+func (w *redactingWriter) addURI(uri string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// Replace the connection string as a whole first, so it remains legible.
+	w.pairs = append(w.pairs, uri, redactURI(uri))
+
+	if m := rawPasswordRe.FindStringSubmatch(uri); m != nil && len(m[1]) >= minSecretLength {
+		w.pairs = append(w.pairs, m[1], redacted)
+	}
+	if conf, err := pgx.ParseConfig(uri); err == nil && len(conf.Password) >= minSecretLength {
+		w.pairs = append(w.pairs, conf.Password, redacted)
+	}
+
+	w.replacer = strings.NewReplacer(w.pairs...)
+}
+
+// addSecret registers a credential, such as an access key, for redaction.
+func (w *redactingWriter) addSecret(secret string) {
+	if len(secret) < minSecretLength {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.pairs = append(w.pairs, secret, redacted)
+	w.replacer = strings.NewReplacer(w.pairs...)
+}
+
+// redact masks the registered credentials within s.
+func (w *redactingWriter) redact(s string) string {
+	w.mu.Lock()
+	replacer := w.replacer
+	w.mu.Unlock()
+
+	return replacer.Replace(s)
+}
+
+func (w *redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.out, w.redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
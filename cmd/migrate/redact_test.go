@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const testPassword = "s3cr3t-p4ss"
+
+func TestRedactURI(t *testing.T) {
+	for _, uri := range []string{
+		"postgres://app:" + testPassword + "@db.example.com:5432/app",
+		"postgresql://app:" + testPassword + "@db.example.com/app?sslmode=require",
+		"postgres://app@db.example.com/app?password=" + testPassword,
+		"host=db.example.com user=app password=" + testPassword + " dbname=app",
+		"host=db.example.com user=app password = '" + testPassword + "' dbname=app",
+	} {
+		if got := redactURI(uri); strings.Contains(got, testPassword) {
+			t.Errorf("redactURI(%q) = %q, which contains the password", uri, got)
+		}
+	}
+}
+
+func TestFormatCommandRedactsPasswords(t *testing.T) {
+	got := formatCommand("pg_dump", []string{
+		"-d", "postgres://app:" + testPassword + "@db.example.com/app",
+		"--dbname=host=db.example.com password=" + testPassword,
+	})
+	if strings.Contains(got, testPassword) {
+		t.Errorf("formatCommand output %q contains the password", got)
+	}
+}
+
+func TestRedactingWriter(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		register func(w *redactingWriter)
+	}{
+		{"uri", func(w *redactingWriter) {
+			w.addURI("postgres://app:" + testPassword + "@db.example.com:5432/app")
+		}},
+		{"percent-encoded uri", func(w *redactingWriter) {
+			w.addURI("postgres://app:" + strings.ReplaceAll(testPassword, "-", "%2D") + "@db.example.com:5432/app")
+		}},
+		{"dsn", func(w *redactingWriter) {
+			w.addURI("host=db.example.com user=app password=" + testPassword + " dbname=app")
+		}},
+		{"PGPASSWORD", func(w *redactingWriter) {
+			w.addSecret(testPassword)
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			w := newRedactingWriter(&out)
+			tc.register(w)
+
+			// The password may be relayed on its own, as in a client tool's
+			// error, or within a connection string in a message.
+			fmt.Fprintf(w, "[pg_dump] connection to server failed: password %s rejected\n", testPassword)
+			fmt.Fprintf(w, "[info] Connecting to postgres://app:%s@db.example.com:5432/app\n", testPassword)
+			fmt.Fprintf(w, "[info] Connecting to host=db.example.com password=%s\n", testPassword)
+
+			if strings.Contains(out.String(), testPassword) {
+				t.Errorf("output contains the password:\n%s", out.String())
+			}
+			if !strings.Contains(out.String(), redacted) {
+				t.Errorf("output doesn't contain the mask:\n%s", out.String())
+			}
+		})
+	}
+}
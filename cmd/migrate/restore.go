@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// archiveMagic prefixes every custom format archive written by pg_dump.
+var archiveMagic = []byte("PGDMP")
+
+// restoreInput is an existing dump to restore with --restore-from. Archives on
+// disk are read by pg_restore directly from path; everything else is streamed
+// through r.
+type restoreInput struct {
+	path    string
+	r       io.Reader
+	archive bool
+	close   func() error
+}
+
+// restoreExisting loads the dump at opts.restoreFrom into the target, skipping
+// the dump entirely. Plain SQL dumps are applied with psql and archives with
+// pg_restore.
+func restoreExisting(ctx context.Context, d deps, opts migrationOpts, result *migrationResult) error {
+	input, err := openRestoreInput(ctx, opts.restoreFrom)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = input.close() }()
+
+	if input.r == nil {
+		if result.Bytes, err = pathSize(input.path); err != nil {
+			log.Printf("[warn] failed to determine dump size: %s", err)
+		}
+	} else {
+		counter := &countingWriter{w: io.Discard}
+		input.r = io.TeeReader(input.r, counter)
+		defer func() { result.Bytes = counter.Count() }()
+	}
+
+	if input.archive && input.r != nil && opts.jobs > 1 {
+		return fmt.Errorf("--jobs greater than 1 requires --restore-from to be a local archive, as pg_restore can't restore a stream in parallel")
+	}
+
+	if opts.useList != "" && !input.archive {
+		return fmt.Errorf("--use-list requires --restore-from to be a custom or directory archive, but %s is a plain SQL dump", displaySource(opts.restoreFrom))
+	}
+
+	if len(opts.superuserObjects) > 0 {
+		if !input.archive || input.r != nil {
+			return fmt.Errorf("--skip-superuser-objects requires --restore-from to be a local archive, as its table of contents is read before restoring")
+		}
+		list, remove, err := writeRestoreList(ctx, d, opts, input.path)
+		if err != nil {
+			return err
+		}
+		defer remove()
+		opts.useList = list
+	}
+
+	if !input.archive && len(objectArgs(opts)) > 0 {
+		log.Printf("[warn] %s only apply to archives and are ignored when restoring a plain SQL dump", strings.Join(objectArgs(opts), " "))
+	}
+
+	setPhase(phaseRestore)
+	defer startCopyMonitor(ctx, d, opts)()
+
+	var rewrite func(io.Reader) io.Reader
+	if rewritesScript(opts) {
+		rewrite = func(r io.Reader) io.Reader {
+			return rewriteScript(opts, r)
+		}
+	}
+
+	switch {
+	case input.archive && rewrite != nil:
+		log.Printf("[info] Restoring archive %s as a rewritten SQL script", displaySource(opts.restoreFrom))
+		restore := newStage(opts.pgRestorePath, pgRestoreScriptArgs(opts, input.path)...)
+		restore.cmd.stdin = input.r
+		apply := newRestoreStage(opts, opts.psqlPath, restoreArgs(opts)...)
+		apply.input = rewrite
+		_, err = runPipeline(ctx, d.runner, restore, apply)
+	case input.archive:
+		log.Printf("[info] Restoring archive %s", displaySource(opts.restoreFrom))
+		restore := newRestoreStage(opts, opts.pgRestorePath, pgRestoreArgs(opts, input.path)...)
+		restore.cmd.stdin = input.r
+		err = restore.run(ctx, d.runner)
+	default:
+		log.Printf("[info] Restoring SQL dump %s", displaySource(opts.restoreFrom))
+		restore := newRestoreStage(opts, opts.psqlPath, restoreArgs(opts)...)
+		restore.cmd.stdin = input.r
+		if rewrite != nil {
+			restore.cmd.stdin = rewrite(input.r)
+		}
+		err = restore.run(ctx, d.runner)
+	}
+	if err != nil {
+		return classify(ErrRestoreFailed, fmt.Errorf("failed to restore database: %w", err))
+	}
+
+	return nil
+}
+
+// listArchive prints the table of contents of the archive at
+// opts.restoreFrom to stdout, as pg_restore --list does. The output can be
+// edited and passed back with --use-list to restore only part of the archive.
+func listArchive(ctx context.Context, d deps, opts migrationOpts) error {
+	input, err := openRestoreInput(ctx, opts.restoreFrom)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = input.close() }()
+
+	if !input.archive {
+		return fmt.Errorf("--list requires --restore-from to be a custom or directory archive, but %s is a plain SQL dump", displaySource(opts.restoreFrom))
+	}
+
+	args := []string{"--list"}
+	// pg_restore reads the archive from stdin when no path is given.
+	if input.path != "" {
+		args = append(args, input.path)
+	}
+	list := newStage(opts.pgRestorePath, args...)
+	list.cmd.stdin = input.r
+	list.cmd.stdout = os.Stdout
+	if err := list.run(ctx, d.runner); err != nil {
+		return fmt.Errorf("failed to list archive contents: %w", err)
+	}
+	return nil
+}
+
+// openRestoreInput opens the dump at source, which is either a local path or
+// an http(s) URL, and detects whether it's a plain SQL dump or an archive.
+func openRestoreInput(ctx context.Context, source string) (*restoreInput, error) {
+	if isURL(source) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --restore-from url: %w", err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			// The URL may embed credentials in its query, so it's left out.
+			var urlErr *url.Error
+			if errors.As(err, &urlErr) {
+				err = urlErr.Err
+			}
+			return nil, fmt.Errorf("failed to download dump: %w", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			_ = resp.Body.Close()
+			return nil, fmt.Errorf("failed to download dump: unexpected status %s", resp.Status)
+		}
+
+		br := bufio.NewReader(resp.Body)
+		return &restoreInput{r: br, archive: isArchive(br), close: resp.Body.Close}, nil
+	}
+
+	info, err := os.Stat(source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open dump: %w", err)
+	}
+	// Directory format dumps are always archives.
+	if info.IsDir() {
+		return &restoreInput{path: source, archive: true, close: func() error { return nil }}, nil
+	}
+
+	f, err := os.Open(source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open dump: %w", err)
+	}
+	br := bufio.NewReader(f)
+	if isArchive(br) {
+		_ = f.Close()
+		return &restoreInput{path: source, archive: true, close: func() error { return nil }}, nil
+	}
+	return &restoreInput{r: br, close: f.Close}, nil
+}
+
+func isURL(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// displaySource returns source with any credentials in a URL removed, such
+// as the signature of a presigned link.
+func displaySource(source string) string {
+	if !isURL(source) {
+		return source
+	}
+	u, err := url.Parse(source)
+	if err != nil {
+		return redacted
+	}
+	u.User = nil
+	u.RawQuery = ""
+	return u.String()
+}
+
+// isArchive reports whether the stream read by br begins with the custom
+// format's signature, without consuming it.
+func isArchive(br *bufio.Reader) bool {
+	magic, _ := br.Peek(len(archiveMagic))
+	return bytes.Equal(magic, archiveMagic)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// deferConstraintsSQL is run ahead of a --defer-constraints restore, which is
+// applied as a single transaction, so deferrable foreign keys are only checked
+// once every table is loaded.
+const deferConstraintsSQL = "SET CONSTRAINTS ALL DEFERRED;\n"
+
+// rewriteScript applies the rewriting rewritesScript calls for to the restore
+// script r.
+func rewriteScript(opts migrationOpts, r io.Reader) io.Reader {
+	if len(opts.tablespaceMap) > 0 || len(opts.ownerMap) > 0 {
+		r = newScriptRewriter(r, opts.tablespaceMap, opts.ownerMap)
+	}
+	if opts.deferConstraints {
+		r = io.MultiReader(strings.NewReader(deferConstraintsSQL), r)
+	}
+	return r
+}
+
+// scriptRewriter rewrites the tablespaces and owners referenced by a SQL script
+// generated by pg_dump as it is read. Tablespaces are assigned through SET
+// default_tablespace ahead of each object, plus a TABLESPACE clause on CREATE
+// DATABASE, and owners through ALTER ... OWNER TO, so only those statements
+// need translating. COPY data is passed through untouched.
+type scriptRewriter struct {
+	r           *bufio.Reader
+	tablespaces map[string]string
+	owners      map[string]string
+	inCopy      bool
+	buf         []byte
+	err         error
+}
+
+func newScriptRewriter(r io.Reader, tablespaces, owners map[string]string) *scriptRewriter {
+	return &scriptRewriter{
+		r:           bufio.NewReaderSize(r, 64*1024),
+		tablespaces: tablespaces,
+		owners:      owners,
+	}
+}
+
+func (t *scriptRewriter) Read(p []byte) (int, error) {
+	for len(t.buf) == 0 {
+		if t.err != nil {
+			return 0, t.err
+		}
+		var line []byte
+		line, t.err = t.r.ReadBytes('\n')
+		t.buf = t.rewrite(line)
+	}
+
+	n := copy(p, t.buf)
+	t.buf = t.buf[n:]
+	return n, nil
+}
+
+const (
+	setTablespacePrefix = "SET default_tablespace = "
+	tablespaceClause    = " TABLESPACE = "
+	ownerClause         = " OWNER TO "
+)
+
+func (t *scriptRewriter) rewrite(line []byte) []byte {
+	if t.inCopy {
+		if bytes.Equal(line, []byte("\\.\n")) {
+			t.inCopy = false
+		}
+		return line
+	}
+
+	s := string(line)
+	switch {
+	case strings.HasPrefix(s, "COPY ") && strings.HasSuffix(strings.TrimSpace(s), "FROM stdin;"):
+		t.inCopy = true
+	case strings.HasPrefix(s, setTablespacePrefix):
+		if replaced, ok := replaceIdentifier(t.tablespaces, s, len(setTablespacePrefix)); ok {
+			return []byte(replaced)
+		}
+	case strings.HasPrefix(s, "CREATE DATABASE "):
+		if i := strings.Index(s, tablespaceClause); i >= 0 {
+			if replaced, ok := replaceIdentifier(t.tablespaces, s, i+len(tablespaceClause)); ok {
+				return []byte(replaced)
+			}
+		}
+	case strings.HasPrefix(s, "ALTER "):
+		if i := strings.LastIndex(s, ownerClause); i >= 0 {
+			if replaced, ok := replaceIdentifier(t.owners, s, i+len(ownerClause)); ok {
+				return []byte(replaced)
+			}
+		}
+	}
+
+	return line
+}
+
+// replaceIdentifier swaps the identifier starting at offset in s for its entry
+// in mapping, reporting whether one applied.
+func replaceIdentifier(mapping map[string]string, s string, offset int) (string, bool) {
+	name, rest := splitIdentifier(s[offset:])
+	replacement, ok := mapping[name]
+	if !ok || name == "" {
+		return "", false
+	}
+	return s[:offset] + pgx.Identifier{replacement}.Sanitize() + rest, true
+}
+
+// splitIdentifier splits a leading, possibly double quoted, SQL identifier from
+// s and returns its unquoted name and the remainder of s.
+func splitIdentifier(s string) (string, string) {
+	if !strings.HasPrefix(s, `"`) {
+		end := strings.IndexAny(s, " ;\n")
+		if end < 0 {
+			end = len(s)
+		}
+		return s[:end], s[end:]
+	}
+
+	var name strings.Builder
+	for i := 1; i < len(s); i++ {
+		if s[i] != '"' {
+			name.WriteByte(s[i])
+			continue
+		}
+		if i+1 < len(s) && s[i+1] == '"' {
+			name.WriteByte('"')
+			i++
+			continue
+		}
+		return name.String(), s[i+1:]
+	}
+
+	// Unterminated quotes are left for the server to reject.
+	return "", s
+}
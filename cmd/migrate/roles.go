@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// providerRoles are the administrative roles of managed Postgres services,
+// which can't be created on the target and mean nothing there.
+var providerRoles = []string{
+	// Amazon RDS and Aurora
+	"rds_superuser", "rdsadmin", "rdsrepladmin", "rds_replication", "rds_iam", "rds_password", "rdstopmgr", "rds_ad",
+	// Google Cloud SQL
+	"cloudsqlsuperuser", "cloudsqladmin", "cloudsqlagent", "cloudsqlimportexport", "cloudsqlreplica", "cloudsqliamuser", "cloudsqliamserviceaccount",
+	// Azure Database for PostgreSQL
+	"azure_superuser", "azure_pg_admin", "azuresu",
+}
+
+// migrateRoles copies role definitions from the source cluster into the
+// target. Roles that already exist on the target are left as they are, so
+// only their memberships are copied. Any other statement psql fails on is
+// logged and otherwise ignored so the remaining definitions are still
+// applied, which is why psql runs without ON_ERROR_STOP here.
+func migrateRoles(ctx context.Context, d deps, opts migrationOpts) error {
+	targetConf, err := pgx.ParseConfig(opts.targetURI)
+	if err != nil {
+		return fmt.Errorf("failed to parse target uri: %w", err)
+	}
+
+	// Never carry over the role we restore as, as its password and attributes
+	// on the target must be left untouched.
+	excluded := append([]string{targetConf.User}, opts.excludeRoles...)
+	excluded = append(excluded, providerRoles...)
+
+	conn, err := d.opener.Open(ctx, opts.targetURI)
+	if err != nil {
+		return classify(ErrTargetUnreachable, fmt.Errorf("failed to connect to target: %w", err))
+	}
+	rows, err := conn.Query(ctx, "SELECT rolname FROM pg_roles")
+	if err != nil {
+		_ = conn.Close(ctx)
+		return fmt.Errorf("failed to query target roles: %w", err)
+	}
+	existing, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	_ = conn.Close(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to query target roles: %w", err)
+	}
+
+	var roles bytes.Buffer
+	dump := newStage(opts.pgDumpallPath, "--roles-only", "-d", opts.sourceURI)
+	dump.cmd.stdout = &roles
+	err = dump.run(ctx, d.runner)
+	// Managed services don't let anyone read pg_authid, where passwords are
+	// kept, so roles can only be dumped without them.
+	if err != nil && strings.Contains(err.Error(), "permission denied for table pg_authid") {
+		log.Println("[warn] The source user can't read role passwords, as on managed services, so roles are copied without them. set their passwords on the target once the import completes")
+		roles.Reset()
+		dump = newStage(opts.pgDumpallPath, "--roles-only", "--no-role-passwords", "-d", opts.sourceURI)
+		dump.cmd.stdout = &roles
+		err = dump.run(ctx, d.runner)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to dump roles: %w", err)
+	}
+
+	restore := newRestoreStage(opts, opts.psqlPath, "-d", opts.targetURI)
+	restore.cmd.stdin = strings.NewReader(filterRoles(roles.String(), excluded, existing))
+	if err := restore.run(ctx, d.runner); err != nil {
+		return fmt.Errorf("failed to restore roles: %w", err)
+	}
+
+	return nil
+}
+
+// filterRoles drops statements from pg_dumpall output that reference any of
+// the excluded roles, and the CREATE ROLE and ALTER ROLE statements of those
+// that already exist.
+func filterRoles(dump string, excluded, existing []string) string {
+	var out strings.Builder
+
+	scanner := bufio.NewScanner(strings.NewReader(dump))
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		// Memberships granted by an excluded role, as on managed services,
+		// are granted by the target user instead.
+		if grant, grantor, ok := strings.Cut(line, " GRANTED BY "); ok && strings.HasPrefix(line, "GRANT ") {
+			if _, ok := matchRole(strings.TrimRight(grantor, ";"), excluded); ok {
+				line = grant + ";"
+			}
+		}
+		if role, ok := referencedRole(line, excluded); ok {
+			log.Printf("[info] Skipping role statement referencing %q", role)
+			continue
+		}
+		if role, ok := definedRole(line, existing); ok {
+			if strings.HasPrefix(line, "CREATE ROLE ") {
+				log.Printf("[info] Role %q already exists on the target, so it's left unchanged", role)
+			}
+			continue
+		}
+		out.WriteString(line)
+		out.WriteString("\n")
+	}
+
+	return out.String()
+}
+
+// definedRole reports whether a CREATE ROLE or ALTER ROLE statement defines
+// one of roles, returning the matching role.
+func definedRole(line string, roles []string) (string, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 || fields[1] != "ROLE" || (fields[0] != "CREATE" && fields[0] != "ALTER") {
+		return "", false
+	}
+	// Only the role being defined, not those it's granted to or by.
+	return referencedRole(strings.Join(fields[:3], " "), roles)
+}
+
+// referencedRole reports whether a role statement references one of roles,
+// returning the matching role.
+func referencedRole(line string, roles []string) (string, bool) {
+	if !strings.HasPrefix(line, "CREATE ROLE ") && !strings.HasPrefix(line, "ALTER ROLE ") && !strings.HasPrefix(line, "GRANT ") {
+		return "", false
+	}
+
+	for _, token := range strings.Fields(line) {
+		if role, ok := matchRole(strings.TrimRight(token, ";,"), roles); ok {
+			return role, true
+		}
+	}
+
+	return "", false
+}
+
+// matchRole reports whether token names one of roles, quoted or not,
+// returning the matching role.
+func matchRole(token string, roles []string) (string, bool) {
+	for _, role := range roles {
+		if token == role || token == (pgx.Identifier{role}).Sanitize() {
+			return role, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3Location is an object addressed as s3://bucket/key.
+type s3Location struct {
+	bucket string
+	key    string
+}
+
+func (l s3Location) String() string {
+	return "s3://" + l.bucket + "/" + l.key
+}
+
+func parseS3Location(value string) (s3Location, error) {
+	rest, ok := strings.CutPrefix(value, "s3://")
+	if !ok {
+		return s3Location{}, fmt.Errorf("invalid s3 location %q. expected s3://bucket/key", value)
+	}
+	bucket, key, _ := strings.Cut(rest, "/")
+	if bucket == "" || key == "" || strings.HasSuffix(key, "/") {
+		return s3Location{}, fmt.Errorf("invalid s3 location %q. expected s3://bucket/key", value)
+	}
+	return s3Location{bucket: bucket, key: key}, nil
+}
+
+// s3Client issues SigV4 signed requests against S3 or an S3 compatible
+// service.
+type s3Client struct {
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	region       string
+	// endpoint, when set, is the base URL of an S3 compatible service and
+	// objects are addressed path-style beneath it.
+	endpoint string
+	http     *http.Client
+}
+
+// newS3ClientFromEnv configures a client from the standard AWS environment
+// variables.
+func newS3ClientFromEnv(getenv func(string) string) (*s3Client, error) {
+	c := &s3Client{
+		accessKey:    getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: getenv("AWS_SESSION_TOKEN"),
+		region:       getenv("AWS_REGION"),
+		endpoint:     getenv("AWS_ENDPOINT_URL_S3"),
+		http:         http.DefaultClient,
+	}
+	if c.accessKey == "" || c.secretKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set to upload to s3")
+	}
+	if c.region == "" {
+		c.region = getenv("AWS_DEFAULT_REGION")
+	}
+	if c.region == "" {
+		c.region = "us-east-1"
+	}
+	if c.endpoint == "" {
+		c.endpoint = getenv("AWS_ENDPOINT_URL")
+	}
+
+	return c, nil
+}
+
+// objectURL returns the URL of the object at loc with the given query.
+func (c *s3Client) objectURL(loc s3Location, query url.Values) (*url.URL, error) {
+	var u *url.URL
+	if c.endpoint != "" {
+		base, err := url.Parse(strings.TrimSuffix(c.endpoint, "/"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid s3 endpoint: %w", err)
+		}
+		u = base.JoinPath(loc.bucket, loc.key)
+	} else {
+		u = &url.URL{
+			Scheme: "https",
+			Host:   fmt.Sprintf("%s.s3.%s.amazonaws.com", loc.bucket, c.region),
+			Path:   "/" + loc.key,
+		}
+	}
+	// The path is sent exactly as it's signed.
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+
+	return u, nil
+}
+
+// do signs and sends a request, returning the response body of a successful
+// call.
+func (c *s3Client) do(ctx context.Context, method string, loc s3Location, query url.Values, body []byte) (http.Header, []byte, error) {
+	u, err := c.objectURL(loc, query)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	c.sign(req, body, time.Now().UTC())
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if resp.StatusCode/100 != 2 {
+		var s3Err struct {
+			Code    string
+			Message string
+		}
+		if xml.Unmarshal(data, &s3Err) == nil && s3Err.Code != "" {
+			return nil, nil, fmt.Errorf("%s: %s: %s", resp.Status, s3Err.Code, s3Err.Message)
+		}
+		return nil, nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return resp.Header, data, nil
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req.
+func (c *s3Client) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+
+	var names []string
+	for name := range req.Header {
+		names = append(names, strings.ToLower(name))
+	}
+	sort.Strings(names)
+
+	var headers strings.Builder
+	for _, name := range names {
+		headers.WriteString(name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		headers.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), date)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, signature))
+}
+
+// canonicalQuery encodes query with sorted keys and AWS's escaping rules, so
+// the string sent matches the one signed.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode escapes every byte outside the unreserved set, optionally keeping
+// slashes so paths remain legible.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case 'A' <= ch && ch <= 'Z', 'a' <= ch && ch <= 'z', '0' <= ch && ch <= '9',
+			ch == '-', ch == '_', ch == '.', ch == '~':
+			b.WriteByte(ch)
+		case ch == '/' && !encodeSlash:
+			b.WriteByte(ch)
+		default:
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+const (
+	// minPartSize is the size of the first parts uploaded. S3 requires
+	// every part but the last to be at least 5 MiB.
+	minPartSize = 16 << 20
+	// partsPerSizeStep is how many parts are uploaded before the part size
+	// doubles. S3 caps uploads at 10,000 parts, so growing the parts keeps
+	// memory low for small dumps while still allowing very large ones.
+	partsPerSizeStep = 1000
+	// partAttempts is how many times a part is sent before giving up.
+	partAttempts = 3
+)
+
+// s3Upload streams everything written to it into an object with a multipart
+// upload. At most one part is buffered in memory at a time.
+type s3Upload struct {
+	ctx      context.Context
+	client   *s3Client
+	loc      s3Location
+	uploadID string
+	etags    []string
+	buf      []byte
+	size     int64
+	err      error
+	done     bool
+}
+
+// newS3Upload starts a multipart upload to loc.
+func newS3Upload(ctx context.Context, client *s3Client, loc s3Location) (*s3Upload, error) {
+	_, body, err := client.do(ctx, http.MethodPost, loc, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start upload to %s: %w", loc, err)
+	}
+
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(body, &result); err != nil || result.UploadID == "" {
+		return nil, fmt.Errorf("failed to start upload to %s: unexpected response", loc)
+	}
+
+	return &s3Upload{ctx: ctx, client: client, loc: loc, uploadID: result.UploadID}, nil
+}
+
+func (u *s3Upload) partSize() int {
+	return minPartSize << (len(u.etags) / partsPerSizeStep)
+}
+
+func (u *s3Upload) Write(p []byte) (int, error) {
+	if u.err != nil {
+		return 0, u.err
+	}
+
+	u.buf = append(u.buf, p...)
+	for len(u.buf) >= u.partSize() {
+		size := u.partSize()
+		if err := u.uploadPart(u.buf[:size]); err != nil {
+			u.err = err
+			return 0, err
+		}
+		u.buf = append(u.buf[:0], u.buf[size:]...)
+	}
+
+	return len(p), nil
+}
+
+func (u *s3Upload) uploadPart(data []byte) error {
+	number := len(u.etags) + 1
+	query := url.Values{
+		"partNumber": {strconv.Itoa(number)},
+		"uploadId":   {u.uploadID},
+	}
+
+	var err error
+	for attempt := 1; attempt <= partAttempts; attempt++ {
+		var header http.Header
+		header, _, err = u.client.do(u.ctx, http.MethodPut, u.loc, query, data)
+		if err == nil {
+			u.etags = append(u.etags, header.Get("ETag"))
+			u.size += int64(len(data))
+			return nil
+		}
+		if u.ctx.Err() != nil {
+			break
+		}
+		log.Printf("[warn] Upload of part %d to %s failed (attempt %d/%d): %s", number, u.loc, attempt, partAttempts, err)
+	}
+
+	return fmt.Errorf("failed to upload part %d to %s: %w", number, u.loc, err)
+}
+
+// Close uploads any buffered data and completes the upload.
+func (u *s3Upload) Close() error {
+	if u.err != nil {
+		return u.err
+	}
+
+	// S3 requires at least one part, even when the dump is empty.
+	if len(u.buf) > 0 || len(u.etags) == 0 {
+		if err := u.uploadPart(u.buf); err != nil {
+			u.err = err
+			return err
+		}
+		u.buf = nil
+	}
+
+	type part struct {
+		PartNumber int
+		ETag       string
+	}
+	complete := struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}{}
+	for i, etag := range u.etags {
+		complete.Parts = append(complete.Parts, part{PartNumber: i + 1, ETag: etag})
+	}
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+
+	if _, _, err := u.client.do(u.ctx, http.MethodPost, u.loc, url.Values{"uploadId": {u.uploadID}}, body); err != nil {
+		u.err = fmt.Errorf("failed to complete upload to %s: %w", u.loc, err)
+		return u.err
+	}
+	u.done = true
+	log.Printf("[info] Uploaded %d bytes to %s", u.size, u.loc)
+
+	return nil
+}
+
+// Abort cancels the upload so the parts sent so far aren't retained, and
+// billed, by the bucket. Completed uploads are left alone.
+func (u *s3Upload) Abort() {
+	if u.done {
+		return
+	}
+
+	// The upload may be aborted because ctx was cancelled, so a fresh
+	// context is used.
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if _, _, err := u.client.do(ctx, http.MethodDelete, u.loc, url.Values{"uploadId": {u.uploadID}}, nil); err != nil {
+		log.Printf("[warn] failed to abort upload to %s: %s", u.loc, err)
+	}
+}
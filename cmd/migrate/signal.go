@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// terminateGracePeriod is how long child processes are given to exit after
+// SIGTERM before they're killed outright.
+const terminateGracePeriod = 5 * time.Second
+
+// children tracks the process groups and temporary files belonging to the
+// running import so they can be torn down if the import is interrupted.
+var children = &tracker{groups: map[int]struct{}{}, paths: map[string]struct{}{}}
+
+type tracker struct {
+	mu     sync.Mutex
+	groups map[int]struct{}
+	paths  map[string]struct{}
+}
+
+func (t *tracker) addGroup(pgid int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.groups[pgid] = struct{}{}
+}
+
+func (t *tracker) removeGroup(pgid int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.groups, pgid)
+}
+
+func (t *tracker) addPath(path string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.paths[path] = struct{}{}
+}
+
+func (t *tracker) removePath(path string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.paths, path)
+}
+
+// signalGroups sends sig to every tracked process group, returning the number
+// of groups still running.
+func (t *tracker) signalGroups(sig syscall.Signal) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for pgid := range t.groups {
+		_ = syscall.Kill(-pgid, sig)
+	}
+	return len(t.groups)
+}
+
+// terminate stops all tracked process groups and removes tracked paths.
+func (t *tracker) terminate() {
+	if t.signalGroups(syscall.SIGTERM) > 0 {
+		deadline := time.Now().Add(terminateGracePeriod)
+		for time.Now().Before(deadline) && t.signalGroups(0) > 0 {
+			time.Sleep(100 * time.Millisecond)
+		}
+		t.signalGroups(syscall.SIGKILL)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for path := range t.paths {
+		_ = os.RemoveAll(path)
+	}
+}
+
+// interrupted holds the first SIGINT or SIGTERM received, or 0.
+var interrupted atomic.Int32
+
+// handleSignals cancels the import when SIGINT or SIGTERM is received, so
+// running commands are stopped and cleanup deferred along the way still
+// runs as main unwinds. A second signal exits immediately.
+func handleSignals(cancel context.CancelFunc) {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	sig := <-sigs
+	interrupted.Store(int32(sig.(syscall.Signal)))
+	log.Printf("[info] Received %s, cleaning up... send it again to exit immediately", sig)
+	cancel()
+
+	sig = <-sigs
+	log.Printf("[warn] Received %s again, exiting without waiting for cleanup", sig)
+	exit(128 + int(sig.(syscall.Signal)))
+}
+
+// exitIfInterrupted exits with the conventional 128+signal status when the
+// import was interrupted, even if main otherwise returns normally.
+func exitIfInterrupted() {
+	if sig := interrupted.Load(); sig != 0 {
+		exit(128 + int(sig))
+	}
+}
+
+// exit stops any tracked child processes, such as the ssh tunnel, which
+// run in their own process groups and would otherwise outlive the import,
+// then exits with code. Once interrupted, the exit status is always
+// 128+signal, whatever the failure the interruption caused.
+func exit(code int) {
+	if sig := interrupted.Load(); sig != 0 {
+		code = 128 + int(sig)
+	}
+	children.terminate()
+	commandLog.close()
+	os.Exit(code)
+}
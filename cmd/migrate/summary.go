@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// migrationSummary collects statistics about an import for the report
+// printed once it completes.
+type migrationSummary struct {
+	SourceVersion string   `json:"source_version"`
+	TargetVersion string   `json:"target_version"`
+	Database      string   `json:"database"`
+	Schemas       []string `json:"schemas"`
+	Tables        int      `json:"tables"`
+	Rows          int64    `json:"rows"`
+	Bytes         int64    `json:"bytes"`
+	// Duration is measured in seconds.
+	Duration float64 `json:"duration_seconds"`
+	// TransferDuration is the part of Duration spent dumping and restoring,
+	// leaving out the pre-checks and post-restore steps, in seconds.
+	TransferDuration float64 `json:"transfer_duration_seconds,omitempty"`
+	// Throughput is Bytes over TransferDuration.
+	Throughput float64 `json:"throughput_bytes_per_second,omitempty"`
+	// Databases reports each database imported with --all-databases.
+	Databases []databaseResult `json:"databases,omitempty"`
+	// TableTimings reports each table copied by the pgx engine.
+	TableTimings []tableTiming `json:"table_timings,omitempty"`
+	// Checksums reports each table compared by --verify-checksum.
+	Checksums []tableChecksum `json:"checksums,omitempty"`
+
+	// verified is set when the table and row counts have been collected.
+	verified bool
+}
+
+// addResult records what runMigration transferred. Counts collected by
+// verification later take precedence.
+func (s *migrationSummary) addResult(r migrationResult) {
+	s.Tables = r.Tables
+	s.Rows = r.Rows
+	s.Bytes = r.Bytes
+	s.TransferDuration = r.Duration.Seconds()
+	s.TableTimings = r.TableTimings
+}
+
+// printSummary logs the report. Under --log-format=json it's emitted as a
+// single structured event instead.
+func printSummary(s *migrationSummary, logFormat string) {
+	if s.Bytes > 0 && s.TransferDuration > 0 {
+		s.Throughput = float64(s.Bytes) / s.TransferDuration
+	}
+	if logFormat == logFormatJSON {
+		b, err := json.Marshal(s)
+		if err != nil {
+			log.Printf("[warn] failed to encode summary: %s", err)
+			return
+		}
+		log.Printf("[event:summary] %s", b)
+		return
+	}
+
+	rows := [][]string{
+		{"Source version:", s.SourceVersion},
+		{"Target version:", s.TargetVersion},
+	}
+	// Imports of every database list them individually below instead.
+	if len(s.Databases) == 0 {
+		rows = append(rows, []string{"Database:", s.Database})
+	}
+	if s.verified {
+		rows = append(rows, []string{"Schemas:", strings.Join(s.Schemas, ", ")})
+	}
+	if s.verified || len(s.TableTimings) > 0 {
+		rows = append(rows,
+			[]string{"Tables:", fmt.Sprint(s.Tables)},
+			[]string{"Rows:", fmt.Sprint(s.Rows)},
+		)
+	}
+	if len(s.Checksums) > 0 {
+		matched := 0
+		for _, c := range s.Checksums {
+			if c.Match {
+				matched++
+			}
+		}
+		rows = append(rows, []string{"Checksums:", fmt.Sprintf("%d of %d tables match", matched, len(s.Checksums))})
+	}
+	rows = append(rows,
+		[]string{"Bytes transferred:", fmt.Sprint(s.Bytes)},
+		[]string{"Duration:", (time.Duration(s.Duration * float64(time.Second))).Round(time.Millisecond).String()},
+	)
+	if s.Throughput > 0 {
+		rows = append(rows, []string{"Throughput:", formatBytes(int64(s.Throughput)) + "/s"})
+	}
+
+	log.Println("[info] Summary:")
+	for _, line := range formatTable(rows) {
+		log.Println("  " + line)
+	}
+
+	if len(s.Databases) == 0 {
+		return
+	}
+	results := [][]string{{"DATABASE", "TABLES", "ROWS", "BYTES", "DURATION", "RESULT"}}
+	for _, db := range s.Databases {
+		result := "ok"
+		if db.Error != "" {
+			result = "failed: " + db.Error
+		}
+		results = append(results, []string{
+			db.Database,
+			fmt.Sprint(db.Tables),
+			fmt.Sprint(db.Rows),
+			fmt.Sprint(db.Bytes),
+			(time.Duration(db.Duration * float64(time.Second))).Round(time.Millisecond).String(),
+			result,
+		})
+	}
+	for _, line := range formatTable(results) {
+		log.Println("  " + line)
+	}
+}
+
+// pathSize returns the size of the file at path, or the combined size of the
+// files within it when path is a directory.
+func pathSize(path string) (int64, error) {
+	var size int64
+	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// superuserObject is an object only a superuser can restore, identified as
+// pg_restore lists it in an archive's table of contents.
+type superuserObject struct {
+	// kind is the object type, e.g. EVENT TRIGGER or FUNCTION.
+	kind string
+	// schema is "-" for objects that don't belong to one.
+	schema string
+	// name is empty to match every object of kind.
+	name string
+}
+
+func (o superuserObject) String() string {
+	if o.schema == "-" {
+		return strings.ToLower(o.kind) + " " + o.name
+	}
+	return fmt.Sprintf("%s %s.%s", strings.ToLower(o.kind), o.schema, o.name)
+}
+
+// checkSuperuserObjects warns about objects in the source that only a
+// superuser can restore, when the target user isn't one. With
+// --skip-superuser-objects they're recorded in opts so they can be filtered
+// out of the restore instead. Without a source connection only event triggers
+// and extensions are recognized, and nothing is listed.
+func checkSuperuserObjects(ctx context.Context, sourceConn, targetConn dbConn, opts *migrationOpts, sourceMajor, targetMajor int) error {
+	var superuser bool
+	if err := targetConn.QueryRow(ctx, "SELECT rolsuper FROM pg_roles WHERE rolname = current_user").Scan(&superuser); err != nil {
+		return fmt.Errorf("failed to query target role: %w", err)
+	}
+	if superuser {
+		if opts.skipSuperuserObjects {
+			log.Printf("[info] The target user %q is a superuser, so nothing is skipped by --skip-superuser-objects", targetConn.Config().User)
+		}
+		return nil
+	}
+
+	extensions, err := superuserExtensions(ctx, targetConn, targetMajor)
+	if err != nil {
+		return err
+	}
+
+	if sourceConn == nil {
+		if opts.skipSuperuserObjects {
+			opts.superuserObjects = append([]superuserObject{{kind: "EVENT TRIGGER", schema: "-"}}, extensions...)
+		}
+		return nil
+	}
+
+	objects, err := findSuperuserObjects(ctx, sourceConn, sourceMajor)
+	if err != nil {
+		return err
+	}
+	rows, err := sourceConn.Query(ctx, "SELECT extname FROM pg_extension")
+	if err != nil {
+		return fmt.Errorf("failed to query source extensions: %w", err)
+	}
+	installed, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return fmt.Errorf("failed to query source extensions: %w", err)
+	}
+	for _, ext := range extensions {
+		if contains(installed, ext.name) {
+			objects = append(objects, ext)
+		}
+	}
+	if len(objects) == 0 {
+		return nil
+	}
+
+	names := make([]string, len(objects))
+	for i, o := range objects {
+		names[i] = o.String()
+	}
+	if opts.skipSuperuserObjects {
+		log.Printf("[info] Skipping objects that require a superuser to restore (--skip-superuser-objects): %s", abbreviateList(names))
+		opts.superuserObjects = objects
+		return nil
+	}
+	log.Printf("[warn] The source has objects that require a superuser to restore, and the target user %q isn't one: %s. the restore may fail on them. pass --skip-superuser-objects to leave them out", targetConn.Config().User, abbreviateList(names))
+	return nil
+}
+
+// findSuperuserObjects returns the event triggers on conn, and the functions
+// written in untrusted languages that don't belong to an extension.
+func findSuperuserObjects(ctx context.Context, conn dbConn, major int) ([]superuserObject, error) {
+	rows, err := conn.Query(ctx, "SELECT evtname FROM pg_event_trigger ORDER BY evtname")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query source event triggers: %w", err)
+	}
+	triggers, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("failed to query source event triggers: %w", err)
+	}
+
+	var objects []superuserObject
+	for _, name := range triggers {
+		objects = append(objects, superuserObject{kind: "EVENT TRIGGER", schema: "-", name: name})
+	}
+
+	// Procedures were added in Postgres 11, along with prokind.
+	kind := "'FUNCTION'"
+	if major >= 1100 {
+		kind = "CASE p.prokind WHEN 'p' THEN 'PROCEDURE' ELSE 'FUNCTION' END"
+	}
+	rows, err = conn.Query(ctx, `SELECT `+kind+`, n.nspname,
+			p.proname || '(' || pg_get_function_identity_arguments(p.oid) || ')'
+		FROM pg_proc p
+		JOIN pg_language l ON l.oid = p.prolang
+		JOIN pg_namespace n ON n.oid = p.pronamespace
+		WHERE NOT l.lanpltrusted
+			AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+			AND NOT EXISTS (SELECT 1 FROM pg_depend d
+				WHERE d.classid = 'pg_proc'::regclass AND d.objid = p.oid AND d.deptype = 'e')
+		ORDER BY 2, 3`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query source functions: %w", err)
+	}
+	functions, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (superuserObject, error) {
+		var o superuserObject
+		err := row.Scan(&o.kind, &o.schema, &o.name)
+		return o, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query source functions: %w", err)
+	}
+
+	return append(objects, functions...), nil
+}
+
+// superuserExtensions returns the extensions only a superuser can create on
+// conn, leaving out those already installed there, as the restore skips
+// them. Trusted extensions were added in Postgres 13.
+func superuserExtensions(ctx context.Context, conn dbConn, major int) ([]superuserObject, error) {
+	trusted := ""
+	if major >= 1300 {
+		trusted = " AND NOT trusted"
+	}
+	rows, err := conn.Query(ctx, `SELECT DISTINCT name FROM pg_available_extension_versions
+		WHERE superuser`+trusted+`
+			AND name NOT IN (SELECT extname FROM pg_extension)
+		ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query target extensions: %w", err)
+	}
+	names, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("failed to query target extensions: %w", err)
+	}
+
+	extensions := make([]superuserObject, len(names))
+	for i, name := range names {
+		extensions[i] = superuserObject{kind: "EXTENSION", schema: "-", name: name}
+	}
+	return extensions, nil
+}
+
+// writeRestoreList writes the table of contents of the archive at path, or
+// the --use-list given instead, to a temporary file, leaving out
+// opts.superuserObjects along with their comments and privileges, for
+// pg_restore --use-list. The returned function removes the file.
+func writeRestoreList(ctx context.Context, d deps, opts migrationOpts, path string) (string, func(), error) {
+	var toc bytes.Buffer
+	if opts.useList != "" {
+		b, err := os.ReadFile(opts.useList)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to read --use-list: %w", err)
+		}
+		toc.Write(b)
+	} else {
+		list := newStage(opts.pgRestorePath, "--list", path)
+		list.cmd.stdout = &toc
+		if err := list.run(ctx, d.runner); err != nil {
+			return "", nil, fmt.Errorf("failed to list archive contents: %w", err)
+		}
+	}
+
+	f, err := os.CreateTemp(opts.tempDir, "pg-import-*.list")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create restore list: %w", err)
+	}
+	children.addPath(f.Name())
+	remove := func() {
+		_ = os.Remove(f.Name())
+		children.removePath(f.Name())
+	}
+	defer func() { _ = f.Close() }()
+
+	w := bufio.NewWriter(f)
+	scanner := bufio.NewScanner(&toc)
+	for scanner.Scan() {
+		entry := scanner.Text()
+		if matchSuperuserObject(entry, opts.superuserObjects) {
+			log.Printf("[info] Skipping archive entry %s", entry)
+			// Skipped entries are commented out, as when editing a list by
+			// hand.
+			entry = ";" + entry
+		}
+		if _, err := fmt.Fprintln(w, entry); err != nil {
+			remove()
+			return "", nil, fmt.Errorf("failed to write restore list: %w", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		remove()
+		return "", nil, fmt.Errorf("failed to write restore list: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		remove()
+		return "", nil, fmt.Errorf("failed to write restore list: %w", err)
+	}
+
+	return f.Name(), remove, nil
+}
+
+// matchSuperuserObject reports whether the table of contents entry restores
+// one of objects. Entries have the form
+//
+//	<id>; <catalog oid> <oid> <type> <schema> <name> <owner>
+//
+// where the comments and privileges of an object are listed as COMMENT or
+// ACL entries with the object's type prefixed to its name.
+func matchSuperuserObject(entry string, objects []superuserObject) bool {
+	if strings.HasPrefix(entry, ";") {
+		return false
+	}
+	_, entry, ok := strings.Cut(entry, "; ")
+	if !ok {
+		return false
+	}
+	fields := strings.SplitN(entry, " ", 3)
+	if len(fields) < 3 {
+		return false
+	}
+	desc := fields[2] + " "
+
+	for _, o := range objects {
+		for _, prefix := range []string{
+			o.kind + " " + o.schema + " " + o.name,
+			"COMMENT " + o.schema + " " + o.kind + " " + o.name,
+			"ACL " + o.schema + " " + o.kind + " " + o.name,
+		} {
+			// An empty name matches any object of the kind.
+			if o.name != "" {
+				prefix += " "
+			}
+			if strings.HasPrefix(desc, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
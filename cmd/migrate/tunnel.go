@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// tunnelReadyTimeout is how long ssh is given to open the local forward.
+const tunnelReadyTimeout = 30 * time.Second
+
+// tunnelOpts describes the bastion the source is reached through.
+type tunnelOpts struct {
+	// destination is the user@host passed to ssh.
+	destination string
+	port        string
+	key         string
+}
+
+// parseTunnel parses a --ssh-tunnel value of the form [user@]host[:port].
+// IPv6 hosts are given in brackets when followed by a port, as in
+// user@[fdaa::3]:2222.
+func parseTunnel(value, key string) (*tunnelOpts, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	invalid := fmt.Errorf("invalid --ssh-tunnel %q. expected [user@]host[:port]", value)
+	t := &tunnelOpts{port: "22", key: key}
+	user, host := "", value
+	if at := strings.LastIndex(value, "@"); at >= 0 {
+		user, host = value[:at+1], value[at+1:]
+	}
+
+	switch {
+	case strings.HasPrefix(host, "["):
+		end := strings.Index(host, "]")
+		if end < 0 {
+			return nil, invalid
+		}
+		if rest := host[end+1:]; rest != "" {
+			if !strings.HasPrefix(rest, ":") {
+				return nil, invalid
+			}
+			t.port = rest[1:]
+		}
+		// ssh takes IPv6 destinations without brackets.
+		host = host[1:end]
+	case strings.Count(host, ":") == 1:
+		host, t.port, _ = strings.Cut(host, ":")
+	}
+
+	if n, err := strconv.Atoi(t.port); err != nil || n < 1 || n > 65535 {
+		return nil, fmt.Errorf("invalid --ssh-tunnel port %q", t.port)
+	}
+	if host == "" || user == "@" {
+		return nil, invalid
+	}
+	t.destination = user + host
+	return t, nil
+}
+
+// sshTunnel is a running ssh process forwarding a local port to the source.
+type sshTunnel struct {
+	cancel context.CancelFunc
+	done   chan error
+	// addr is the local end of the forward.
+	addr string
+}
+
+// startTunnel forwards a local port through the bastion to the source host
+// and port in sourceURI, and returns the source URI rewritten to connect
+// through it. The tunnel runs until it's closed.
+func startTunnel(ctx context.Context, runner CommandRunner, t tunnelOpts, sourceURI string) (*sshTunnel, string, error) {
+	conf, err := pgx.ParseConfig(sourceURI)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to parse source uri: %w", err)
+	}
+
+	localPort, err := freePort()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to allocate a local port for the ssh tunnel: %w", err)
+	}
+	remote := net.JoinHostPort(conf.Host, strconv.Itoa(int(conf.Port)))
+	// ssh can forward to a Unix socket on the bastion as well.
+	if isSocketHost(conf.Host) {
+		remote = socketPath(conf.Host, conf.Port)
+	}
+	forward := fmt.Sprintf("127.0.0.1:%d:%s", localPort, remote)
+
+	// BatchMode stops ssh prompting for a password or passphrase there's
+	// nobody to answer, and the forward failing makes ssh exit rather than
+	// run without it.
+	args := []string{
+		"-N", "-L", forward,
+		"-p", t.port,
+		"-o", "BatchMode=yes",
+		"-o", "ExitOnForwardFailure=yes",
+		"-o", "StrictHostKeyChecking=accept-new",
+		"-o", "ServerAliveInterval=30",
+	}
+	if t.key != "" {
+		args = append(args, "-i", t.key)
+	}
+	args = append(args, t.destination)
+
+	tunnelCtx, cancel := context.WithCancel(ctx)
+	s := newStage("ssh", args...)
+	p, err := runner.Start(tunnelCtx, s.cmd)
+	if err != nil {
+		cancel()
+		return nil, "", s.wrap(err)
+	}
+
+	tunnel := &sshTunnel{cancel: cancel, done: make(chan error, 1), addr: net.JoinHostPort("127.0.0.1", strconv.Itoa(localPort))}
+	go func() { tunnel.done <- p.Wait() }()
+
+	if err := tunnel.waitReady(ctx); err != nil {
+		tunnel.Close()
+		return nil, "", s.wrap(err)
+	}
+
+	uri, err := withHostPort(sourceURI, "127.0.0.1", localPort)
+	if err != nil {
+		tunnel.Close()
+		return nil, "", err
+	}
+	return tunnel, uri, nil
+}
+
+// waitReady blocks until the local end of the tunnel accepts connections.
+func (t *sshTunnel) waitReady(ctx context.Context) error {
+	deadline := time.Now().Add(tunnelReadyTimeout)
+	for {
+		conn, err := net.DialTimeout("tcp", t.addr, time.Second)
+		if err == nil {
+			return conn.Close()
+		}
+
+		select {
+		case err := <-t.done:
+			t.done <- err
+			if err == nil {
+				err = fmt.Errorf("exited before the tunnel was ready")
+			}
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(200 * time.Millisecond):
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("tunnel not ready within %s", tunnelReadyTimeout)
+		}
+	}
+}
+
+// Close stops the ssh process and waits for it to exit.
+func (t *sshTunnel) Close() {
+	t.cancel()
+	err := <-t.done
+	t.done <- err
+}
+
+// freePort returns a local port that's currently unused.
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = l.Close() }()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// withHostPort returns uri with its host and port replaced.
+func withHostPort(uri, host string, port int) (string, error) {
+	if strings.HasPrefix(uri, "postgres://") || strings.HasPrefix(uri, "postgresql://") {
+		u, err := url.Parse(uri)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse uri: %w", err)
+		}
+		u.Host = net.JoinHostPort(host, strconv.Itoa(port))
+		// Hosts given as parameters, such as a socket directory, take
+		// precedence over the one in the authority.
+		query := u.Query()
+		if query.Has("host") || query.Has("port") {
+			query.Del("host")
+			query.Del("port")
+			u.RawQuery = query.Encode()
+		}
+		return u.String(), nil
+	}
+
+	// Later keywords take precedence over earlier ones.
+	return fmt.Sprintf("%s host='%s' port='%d'", uri, host, port), nil
+}
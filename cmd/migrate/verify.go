@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// verifyRowCounts compares the number of rows in each migrated table between
+// source and target, returning an error if any of them differ.
+func verifyRowCounts(ctx context.Context, d deps, opts migrationOpts, summary *migrationSummary) error {
+	sourceConn, err := d.opener.Open(ctx, opts.sourceURI)
+	if err != nil {
+		return fmt.Errorf("failed to connect to source: %w", err)
+	}
+	defer func() { _ = sourceConn.Close(ctx) }()
+
+	restoredURI, err := restoredTargetURI(opts)
+	if err != nil {
+		return err
+	}
+
+	targetConn, err := d.opener.Open(ctx, restoredURI)
+	if err != nil {
+		return fmt.Errorf("failed to connect to target: %w", err)
+	}
+	defer func() { _ = targetConn.Close(ctx) }()
+
+	tables, err := listTables(ctx, sourceConn, newTableFilter(opts))
+	if err != nil {
+		return fmt.Errorf("failed to list source tables: %w", err)
+	}
+
+	report := [][]string{{"TABLE", "SOURCE ROWS", "TARGET ROWS", "MATCH"}}
+
+	summary.Database = targetConn.Config().Database
+	summary.Tables = len(tables)
+	summary.Rows = 0
+	summary.verified = true
+
+	var mismatched []string
+	for _, table := range tables {
+		sourceRows, err := countRows(ctx, sourceConn, table)
+		if err != nil {
+			return fmt.Errorf("failed to count rows in source table %s: %w", table, err)
+		}
+
+		target := "missing"
+		targetRows, err := countRows(ctx, targetConn, table)
+		if err == nil {
+			target = fmt.Sprint(targetRows)
+			summary.Rows += targetRows
+		}
+
+		if !contains(summary.Schemas, table.schema) {
+			summary.Schemas = append(summary.Schemas, table.schema)
+		}
+
+		match := err == nil && sourceRows == targetRows
+		if !match {
+			mismatched = append(mismatched, table.String())
+		}
+
+		report = append(report, []string{table.String(), fmt.Sprint(sourceRows), target, fmt.Sprint(match)})
+	}
+
+	log.Println("[info] Row count verification:")
+	for _, line := range formatTable(report) {
+		log.Println("  " + line)
+	}
+
+	if len(mismatched) > 0 {
+		return classify(ErrVerifyFailed, fmt.Errorf("row counts differ for %d table(s): %s", len(mismatched), strings.Join(mismatched, ", ")))
+	}
+
+	return nil
+}
+
+// listTables returns the user tables on conn that are selected by filter.
+func listTables(ctx context.Context, conn dbConn, filter tableFilter) ([]tableRef, error) {
+	rows, err := conn.Query(ctx, `SELECT schemaname, tablename FROM pg_tables
+		WHERE schemaname NOT IN ('pg_catalog', 'information_schema')
+		ORDER BY schemaname, tablename`)
+	if err != nil {
+		return nil, err
+	}
+
+	all, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (tableRef, error) {
+		var t tableRef
+		err := row.Scan(&t.schema, &t.name)
+		return t, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var tables []tableRef
+	for _, t := range all {
+		if filter.includesTable(t) {
+			tables = append(tables, t)
+		}
+	}
+
+	return tables, nil
+}
+
+// checksumSettings make the text form of every row the same on the source and
+// target, whatever their defaults. Floats still differ in the last digits
+// between servers before and after Postgres 12.
+const checksumSettings = `SET TimeZone = 'UTC'; SET DateStyle = 'ISO, MDY'; SET IntervalStyle = 'postgres';
+	SET extra_float_digits = 3; SET bytea_output = 'hex'`
+
+// tableChecksum reports whether the rows of a table hash to the same checksum
+// on the source and target.
+type tableChecksum struct {
+	Table string `json:"table"`
+	// Rows is the number of rows hashed on the source, which is fewer than
+	// the table holds when sampling.
+	Rows  int64 `json:"rows"`
+	Match bool  `json:"match"`
+}
+
+// verifyChecksums compares a checksum of the rows in each migrated table
+// between source and target, returning an error if any of them differ. With
+// --checksum-sample below 100, only that percentage of rows is hashed. Rows
+// are sampled by their hash, so the same rows are picked on both sides.
+func verifyChecksums(ctx context.Context, d deps, opts migrationOpts, summary *migrationSummary) error {
+	sourceConn, err := d.opener.Open(ctx, opts.sourceURI)
+	if err != nil {
+		return fmt.Errorf("failed to connect to source: %w", err)
+	}
+	defer func() { _ = sourceConn.Close(ctx) }()
+
+	restoredURI, err := restoredTargetURI(opts)
+	if err != nil {
+		return err
+	}
+
+	targetConn, err := d.opener.Open(ctx, restoredURI)
+	if err != nil {
+		return fmt.Errorf("failed to connect to target: %w", err)
+	}
+	defer func() { _ = targetConn.Close(ctx) }()
+
+	for _, conn := range []dbConn{sourceConn, targetConn} {
+		if _, err := conn.Exec(ctx, checksumSettings); err != nil {
+			return fmt.Errorf("failed to configure checksum session: %w", err)
+		}
+	}
+
+	tables, err := listTables(ctx, sourceConn, newTableFilter(opts))
+	if err != nil {
+		return fmt.Errorf("failed to list source tables: %w", err)
+	}
+
+	report := [][]string{{"TABLE", "ROWS", "SOURCE CHECKSUM", "TARGET CHECKSUM", "MATCH"}}
+	summary.Checksums = nil
+
+	var mismatched []string
+	for _, table := range tables {
+		sourceRows, sourceSum, err := checksumRows(ctx, sourceConn, table, opts.checksumSample)
+		if err != nil {
+			return fmt.Errorf("failed to checksum source table %s: %w", table, err)
+		}
+
+		target := "missing"
+		targetRows, targetSum, err := checksumRows(ctx, targetConn, table, opts.checksumSample)
+		if err == nil {
+			target = targetSum
+		}
+
+		match := err == nil && sourceRows == targetRows && sourceSum == targetSum
+		if !match {
+			mismatched = append(mismatched, table.String())
+		}
+		summary.Checksums = append(summary.Checksums, tableChecksum{Table: table.String(), Rows: sourceRows, Match: match})
+
+		report = append(report, []string{table.String(), fmt.Sprint(sourceRows), sourceSum, target, fmt.Sprint(match)})
+	}
+
+	log.Println("[info] Checksum verification:")
+	for _, line := range formatTable(report) {
+		log.Println("  " + line)
+	}
+
+	if len(mismatched) > 0 {
+		return classify(ErrVerifyFailed, fmt.Errorf("checksums differ for %d table(s): %s", len(mismatched), strings.Join(mismatched, ", ")))
+	}
+
+	return nil
+}
+
+// checksumRows hashes each row of table with md5 and returns the number of
+// rows hashed, along with the sum of their hashes, which doesn't depend on
+// the order rows are stored in. Only rows whose hash falls within the first
+// sample percent are included.
+func checksumRows(ctx context.Context, conn dbConn, table tableRef, sample int) (int64, string, error) {
+	// Rows are converted with ROW(...) rather than by the table's name, as
+	// a column of the same name would take precedence.
+	sql := `SELECT count(*), coalesce(sum(h), 0)::text FROM (
+		SELECT ('x' || left(md5(ROW(r.*)::text), 16))::bit(64)::bigint AS h
+		FROM ` + pgx.Identifier{table.schema, table.name}.Sanitize() + ` r) hashes`
+	if sample < 100 {
+		sql += fmt.Sprintf(" WHERE abs(h %% 100) < %d", sample)
+	}
+
+	var count int64
+	var sum string
+	err := conn.QueryRow(ctx, sql).Scan(&count, &sum)
+	return count, sum, err
+}
+
+func countRows(ctx context.Context, conn dbConn, table tableRef) (int64, error) {
+	var count int64
+	sql := "SELECT count(*) FROM " + pgx.Identifier{table.schema, table.name}.Sanitize()
+	err := conn.QueryRow(ctx, sql).Scan(&count)
+	return count, err
+}
+
+// schemaObjectKinds are the kinds of object compared by --verify-schema, in
+// the order they're reported.
+var schemaObjectKinds = []string{"tables", "views", "materialized views", "functions", "sequences", "indexes"}
+
+// verifySchemaObjects compares the number of objects of each kind between source and
+// target, returning an error if any of them differ.
+func verifySchemaObjects(ctx context.Context, d deps, opts migrationOpts) error {
+	sourceConn, err := d.opener.Open(ctx, opts.sourceURI)
+	if err != nil {
+		return fmt.Errorf("failed to connect to source: %w", err)
+	}
+	defer func() { _ = sourceConn.Close(ctx) }()
+
+	restoredURI, err := restoredTargetURI(opts)
+	if err != nil {
+		return err
+	}
+
+	targetConn, err := d.opener.Open(ctx, restoredURI)
+	if err != nil {
+		return fmt.Errorf("failed to connect to target: %w", err)
+	}
+	defer func() { _ = targetConn.Close(ctx) }()
+
+	filter := newTableFilter(opts)
+	source, err := countSchemaObjects(ctx, sourceConn, filter)
+	if err != nil {
+		return fmt.Errorf("failed to count source objects: %w", err)
+	}
+	target, err := countSchemaObjects(ctx, targetConn, filter)
+	if err != nil {
+		return fmt.Errorf("failed to count target objects: %w", err)
+	}
+
+	report := [][]string{{"OBJECT", "SOURCE", "TARGET", "MATCH"}}
+	var mismatched []string
+	for _, kind := range schemaObjectKinds {
+		match := source[kind] == target[kind]
+		if !match {
+			mismatched = append(mismatched, fmt.Sprintf("%s (source %d, target %d)", kind, source[kind], target[kind]))
+		}
+		report = append(report, []string{kind, fmt.Sprint(source[kind]), fmt.Sprint(target[kind]), fmt.Sprint(match)})
+	}
+
+	log.Println("[info] Schema verification:")
+	for _, line := range formatTable(report) {
+		log.Println("  " + line)
+	}
+
+	if len(mismatched) > 0 {
+		return classify(ErrVerifyFailed, fmt.Errorf("schema object counts differ: %s", strings.Join(mismatched, ", ")))
+	}
+
+	return nil
+}
+
+// countSchemaObjects counts the user objects on conn of each kind in
+// schemaObjectKinds that are selected by filter. Objects belonging to
+// extensions are left out, as they're recreated along with the extension
+// rather than restored. Indexes are selected by their table, and functions
+// are only dumped when tables aren't selected explicitly.
+func countSchemaObjects(ctx context.Context, conn dbConn, filter tableFilter) (map[string]int, error) {
+	rows, err := conn.Query(ctx, `SELECT CASE c.relkind
+			WHEN 'v' THEN 'views'
+			WHEN 'm' THEN 'materialized views'
+			WHEN 'S' THEN 'sequences'
+			ELSE 'tables'
+		END, n.nspname, c.relname
+		FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind IN ('r', 'p', 'f', 'v', 'm', 'S')
+		AND n.nspname NOT IN ('pg_catalog', 'information_schema') AND n.nspname NOT LIKE 'pg_toast%'
+		AND NOT EXISTS (SELECT 1 FROM pg_depend dep
+			WHERE dep.classid = 'pg_class'::regclass AND dep.objid = c.oid AND dep.deptype = 'e')
+		UNION ALL
+		SELECT 'indexes', n.nspname, t.relname
+		FROM pg_index i
+		JOIN pg_class t ON t.oid = i.indrelid
+		JOIN pg_namespace n ON n.oid = t.relnamespace
+		WHERE n.nspname NOT IN ('pg_catalog', 'information_schema') AND n.nspname NOT LIKE 'pg_toast%'
+		AND NOT EXISTS (SELECT 1 FROM pg_depend dep
+			WHERE dep.classid = 'pg_class'::regclass AND dep.objid = t.oid AND dep.deptype = 'e')
+		UNION ALL
+		SELECT 'functions', n.nspname, p.proname
+		FROM pg_proc p JOIN pg_namespace n ON n.oid = p.pronamespace
+		WHERE n.nspname NOT IN ('pg_catalog', 'information_schema')
+		AND NOT EXISTS (SELECT 1 FROM pg_depend dep
+			WHERE dep.classid = 'pg_proc'::regclass AND dep.objid = p.oid AND dep.deptype = 'e')`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := map[string]int{}
+	for rows.Next() {
+		var kind string
+		var object tableRef
+		if err := rows.Scan(&kind, &object.schema, &object.name); err != nil {
+			return nil, err
+		}
+
+		selected := filter.includesTable(object)
+		if kind == "functions" {
+			selected = len(filter.tables) == 0 && filter.includesSchema(object.schema)
+		}
+		if selected {
+			counts[kind]++
+		}
+	}
+
+	return counts, rows.Err()
+}
+
+// formatTable renders rows as left-aligned columns separated by two spaces.
+func formatTable(rows [][]string) []string {
+	var widths []int
+	for _, row := range rows {
+		for i, cell := range row {
+			if i == len(widths) {
+				widths = append(widths, 0)
+			}
+			if len(cell) > widths[i] {
+				widths[i] = len(cell)
+			}
+		}
+	}
+
+	lines := make([]string, 0, len(rows))
+	for _, row := range rows {
+		var b strings.Builder
+		for i, cell := range row {
+			if i < len(row)-1 {
+				cell += strings.Repeat(" ", widths[i]-len(cell)+2)
+			}
+			b.WriteString(cell)
+		}
+		lines = append(lines, b.String())
+	}
+
+	return lines
+}